@@ -0,0 +1,467 @@
+package kubenurse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/postfinance/kubenurse/internal/servicecheck"
+	"sigs.k8s.io/yaml"
+)
+
+// Options are the options of kubenurse. They are read from the KUBENURSE_CONFIG file, if any, and overridden by
+// the environment variables: the environment variable of an option is its key in upper case, prefixed with
+// KUBENURSE_, e.g. KUBENURSE_NEIGHBOUR_LIMIT for neighbour_limit. See the README for their description.
+type Options struct {
+	// server
+	UseTLS             bool     `json:"use_tls"`
+	CertFile           string   `json:"cert_file"`
+	CertKey            string   `json:"cert_key"`
+	AllowUnschedulable bool     `json:"allow_unschedulable"`
+	ShutdownDuration   Duration `json:"shutdown_duration"`
+	ShutdownDeregister bool     `json:"shutdown_deregister"`
+	UnhealthyThreshold float64  `json:"unhealthy_threshold"`
+	AdminEndpoints     bool     `json:"admin_endpoints"`
+	OpenMetrics        bool     `json:"openmetrics"`
+	UseCache           bool     `json:"use_cache"`
+
+	// scheduling
+	CheckInterval  Duration `json:"check_interval"`
+	StartupDelay   Duration `json:"startup_delay"`
+	RunOnStart     bool     `json:"run_on_start"`
+	RunDeadline    Duration `json:"run_deadline"`
+	FailFast       bool     `json:"fail_fast"`
+	CriticalChecks []string `json:"critical_checks"`
+
+	// metrics
+	HistogramBuckets []float64    `json:"histogram_buckets"`
+	HistogramPreset  string       `json:"histogram_preset"`
+	SuccessWindow    Duration     `json:"success_window"`
+	HealthWeights    weights      `json:"health_weights"`
+	CheckLabel       string       `json:"check_label"`
+	PodLabels        bool         `json:"pod_labels"`
+	AcceptedStatus   statusCodes  `json:"accepted_status"`
+	BodyContains     checkOptions `json:"body_contains"`
+	BodyRegex        checkOptions `json:"body_regex"`
+
+	// checks
+	IngressURL            string   `json:"ingress_url"`
+	ServiceURL            string   `json:"service_url"`
+	ServiceName           string   `json:"service_name"`
+	ServicePort           string   `json:"service_port"`
+	CheckServiceEndpoints bool     `json:"check_service_endpoints"`
+	SelfCheckPath         string   `json:"self_check_path"`
+	CheckAPIServerDirect  bool     `json:"check_api_server_direct"`
+	CheckAPIServerDNS     bool     `json:"check_api_server_dns"`
+	DualStackAPIServer    bool     `json:"dualstack_apiserver"`
+	APIServerEndpoints    []string `json:"apiserver_endpoints"`
+	TokenPath             string   `json:"token_path"`
+	CheckMeIngress        bool     `json:"check_me_ingress"`
+	CheckMeService        bool     `json:"check_me_service"`
+	CheckNeighbourhood    bool     `json:"check_neighbourhood"`
+	CheckDNSProtocols     bool     `json:"check_dns_protocols"`
+	DNSCheckHost          string   `json:"dns_check_host"`
+	InternetCheckURL      string   `json:"internet_check_url"`
+	SOCKSChecks           []string `json:"socks_checks"`
+	WebhookURL            string   `json:"webhook_url"`
+	WebhookMinInterval    Duration `json:"webhook_min_interval"`
+
+	// neighbourhood
+	Namespace               string   `json:"namespace"`
+	NeighbourFilter         string   `json:"neighbour_filter"`
+	NeighbourLimit          int      `json:"neighbour_limit"`
+	NeighbourCheckAll       bool     `json:"neighbour_check_all"`
+	NeighbourIncludeSelf    bool     `json:"neighbour_include_self"`
+	NeighbourFraction       float64  `json:"neighbour_fraction"`
+	NeighbourFractionMin    int      `json:"neighbour_fraction_min"`
+	NeighbourFractionMax    int      `json:"neighbour_fraction_max"`
+	NeighbourScheme         string   `json:"neighbour_scheme"`
+	NeighbourPort           int      `json:"neighbour_port"`
+	NeighbourUseDNS         bool     `json:"neighbour_use_dns"`
+	NeighbourPageSize       int64    `json:"neighbour_page_size"`
+	NeighbourTimeout        Duration `json:"neighbour_timeout"`
+	NeighbourConcurrency    int      `json:"neighbour_concurrency"`
+	SelectedNeighbourMetric bool     `json:"selected_neighbour_metric"`
+
+	// transport
+	ExtraCA          string   `json:"extra_ca"`
+	Insecure         bool     `json:"insecure"`
+	ReuseConnections bool     `json:"reuse_connections"`
+	TLSMinVersion    string   `json:"tls_min_version"`
+	TLSMaxVersion    string   `json:"tls_max_version"`
+	TLSCiphers       []string `json:"tls_ciphers"`
+	DialTimeout      Duration `json:"dial_timeout"`
+	DialKeepAlive    Duration `json:"dial_keepalive"`
+	SourceIP         string   `json:"source_ip"`
+	SOCKSProxy       string   `json:"socks_proxy"`
+}
+
+// DefaultOptions returns the options used if nothing is configured.
+func DefaultOptions() *Options {
+	settings := servicecheck.DefaultSettings()
+
+	return &Options{
+		ShutdownDuration:     Duration(5 * time.Second),
+		UseCache:             true,
+		CheckInterval:        Duration(defaultCheckInterval),
+		RunOnStart:           true,
+		SuccessWindow:        Duration(5 * time.Minute),
+		ServicePort:          "8080",
+		CheckAPIServerDirect: true,
+		CheckAPIServerDNS:    true,
+		CheckMeIngress:       true,
+		CheckMeService:       true,
+		CheckNeighbourhood:   true,
+		WebhookMinInterval:   Duration(time.Minute),
+		NeighbourLimit:       10,
+		NeighbourTimeout:     Duration(2 * time.Second),
+		DialTimeout:          Duration(settings.DialTimeout),
+		DialKeepAlive:        Duration(settings.DialKeepAlive),
+	}
+}
+
+// LoadOptions returns the default options, overridden by the YAML or JSON file at path (if not empty) and then by
+// the environment variables. The file is decoded strictly, unknown options are an error. The options are validated.
+func LoadOptions(path string) (*Options, error) {
+	opts := DefaultOptions()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("read KUBENURSE_CONFIG: %w", err)
+		}
+
+		if err := opts.decode(data); err != nil {
+			return nil, fmt.Errorf("parse KUBENURSE_CONFIG %s: %w", path, err)
+		}
+	}
+
+	if err := opts.applyEnv(); err != nil {
+		return nil, err
+	}
+
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+
+	return opts, nil
+}
+
+// decode overrides the options with the ones of the YAML or JSON document. The options are decoded one by one, so
+// that the errors name the option, whatever its type. Unknown options are an error, null keeps the current value.
+func (o *Options) decode(data []byte) error {
+	var doc map[string]json.RawMessage
+
+	if err := yaml.UnmarshalStrict(data, &doc); err != nil {
+		return err
+	}
+
+	fields := o.fields()
+
+	var errs []error
+
+	for key, value := range doc {
+		field, ok := fields[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown option %q", key))
+			continue
+		}
+
+		if string(value) == "null" {
+			continue
+		}
+
+		if err := json.Unmarshal(value, field.Addr().Interface()); err != nil {
+			errs = append(errs, fmt.Errorf("option %q: %w", key, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// fields returns the fields of the options by key.
+func (o *Options) fields() map[string]reflect.Value {
+	v := reflect.ValueOf(o).Elem()
+	fields := make(map[string]reflect.Value, v.NumField())
+
+	for i := range v.NumField() {
+		key, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		fields[key] = v.Field(i)
+	}
+
+	return fields
+}
+
+// applyEnv overrides the options with the environment variables which are not empty. Like the defaults, boolean
+// options defaulting to true are only disabled by "false", the others are only enabled by "true".
+func (o *Options) applyEnv() error {
+	defaults := DefaultOptions().fields()
+
+	for key, field := range o.fields() {
+		name := "KUBENURSE_" + strings.ToUpper(key)
+
+		env := os.Getenv(name)
+		if env == "" {
+			continue
+		}
+
+		if err := setEnvValue(field, defaults[key], env); err != nil {
+			return fmt.Errorf("parse %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// envDecoder is implemented by the options whose environment variable has a specific format.
+type envDecoder interface {
+	decodeEnv(v string) error
+}
+
+// setEnvValue sets the field to the value of its environment variable.
+func setEnvValue(field, def reflect.Value, env string) error {
+	if d, ok := field.Addr().Interface().(envDecoder); ok {
+		return d.decodeEnv(env)
+	}
+
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(env)
+	case bool:
+		if def.Bool() {
+			field.SetBool(env != "false")
+		} else {
+			field.SetBool(env == "true")
+		}
+	case int, int64:
+		n, err := strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		field.SetInt(n)
+	case float64:
+		f, err := strconv.ParseFloat(env, 64)
+		if err != nil {
+			return err
+		}
+
+		field.SetFloat(f)
+	case []string:
+		var items []string
+
+		for _, item := range strings.Split(env, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+
+		field.Set(reflect.ValueOf(items))
+	case []float64:
+		var items []float64
+
+		for _, item := range strings.Split(env, ",") {
+			f, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+			if err != nil {
+				return err
+			}
+
+			items = append(items, f)
+		}
+
+		field.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported option of type %s", field.Type())
+	}
+
+	return nil
+}
+
+// validate checks the values of the options which can be checked on their own.
+func (o *Options) validate() error {
+	var errs []error
+
+	if o.UnhealthyThreshold < 0 {
+		errs = append(errs, fmt.Errorf("invalid unhealthy_threshold %v, must be a number of checks or a fraction", o.UnhealthyThreshold))
+	}
+
+	if o.NeighbourFraction < 0 || o.NeighbourFraction > 1 {
+		errs = append(errs, fmt.Errorf("invalid neighbour_fraction %v, must be in ]0, 1]", o.NeighbourFraction))
+	}
+
+	if o.NeighbourScheme != "" && o.NeighbourScheme != "http" && o.NeighbourScheme != "https" {
+		errs = append(errs, fmt.Errorf("invalid neighbour_scheme %q, must be http or https", o.NeighbourScheme))
+	}
+
+	if o.NeighbourPort < 0 || o.NeighbourPort > 65535 {
+		errs = append(errs, fmt.Errorf("invalid neighbour_port %d", o.NeighbourPort))
+	}
+
+	// the watch cache is not paginated, it would only return the first page
+	if o.NeighbourPageSize > 0 && o.UseCache {
+		errs = append(errs, errors.New("neighbour_page_size requires use_cache to be false (KUBENURSE_USE_CACHE=false)"))
+	}
+
+	if o.CheckServiceEndpoints && o.ServiceName == "" {
+		errs = append(errs, errors.New("service_name must be set to check the endpoints of the service"))
+	}
+
+	for _, endpoint := range o.APIServerEndpoints {
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			errs = append(errs, fmt.Errorf("invalid apiserver_endpoints entry %q: %w", endpoint, err))
+		}
+	}
+
+	for check, codes := range o.AcceptedStatus {
+		for _, code := range codes {
+			if code < 100 || code > 599 {
+				errs = append(errs, fmt.Errorf("invalid accepted_status for %s: invalid status code %d", check, code))
+			}
+		}
+	}
+
+	if o.WebhookURL != "" {
+		if u, err := url.Parse(o.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, fmt.Errorf("invalid webhook_url %q, must be a http:// or https:// url", o.WebhookURL))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// settings returns the settings of the checker.
+func (o *Options) settings() servicecheck.Settings {
+	return servicecheck.Settings{
+		CheckLabel:       o.CheckLabel,
+		PodLabels:        o.PodLabels,
+		ExtraCA:          o.ExtraCA,
+		Insecure:         o.Insecure,
+		TLSMinVersion:    o.TLSMinVersion,
+		TLSMaxVersion:    o.TLSMaxVersion,
+		TLSCiphers:       o.TLSCiphers,
+		DialTimeout:      time.Duration(o.DialTimeout),
+		DialKeepAlive:    time.Duration(o.DialKeepAlive),
+		SourceIP:         o.SourceIP,
+		SOCKSProxy:       o.SOCKSProxy,
+		ReuseConnections: o.ReuseConnections,
+	}
+}
+
+// redacted returns a copy of the options whose URLs do not contain credentials. Only the scheme and host of the
+// webhook url are kept, webhook services usually authenticate with a token in the path or the query.
+func (o *Options) redacted() *Options {
+	r := *o
+
+	r.IngressURL = redactURL(o.IngressURL)
+	r.ServiceURL = redactURL(o.ServiceURL)
+	r.InternetCheckURL = redactURL(o.InternetCheckURL)
+	r.SOCKSProxy = redactURL(o.SOCKSProxy)
+
+	if u, err := url.Parse(o.WebhookURL); err == nil && o.WebhookURL != "" {
+		r.WebhookURL = u.Scheme + "://" + u.Host + "/xxxxx"
+	}
+
+	return &r
+}
+
+// redactURL replaces a password contained in the given URL.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+
+	return u.Redacted()
+}
+
+// Duration is a time.Duration given as a string formatted for time.ParseDuration, e.g. "10s".
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"10s\": %w", err)
+	}
+
+	return d.decodeEnv(s)
+}
+
+func (d *Duration) decodeEnv(v string) error {
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+
+	return nil
+}
+
+// weights are the weights of the checks in the health score, given as comma-separated check=weight pairs in the
+// environment, e.g. "me_ingress=0.5,neighbourhood=3".
+type weights map[string]float64
+
+func (w *weights) decodeEnv(v string) error {
+	parsed := make(weights)
+
+	for _, pair := range strings.Split(v, ",") {
+		name, weight, found := strings.Cut(pair, "=")
+		if !found {
+			return fmt.Errorf("invalid entry %q, expected check=weight", pair)
+		}
+
+		f, err := strconv.ParseFloat(strings.TrimSpace(weight), 64)
+		if err != nil {
+			return fmt.Errorf("invalid entry %q: %w", pair, err)
+		}
+
+		parsed[strings.TrimSpace(name)] = f
+	}
+
+	*w = parsed
+
+	return nil
+}
+
+// statusCodes are the accepted status codes of the checks, given as semicolon-separated check=codes pairs in the
+// environment, where codes are comma-separated, e.g. "me_ingress=200,204;api_server_direct=200,401".
+type statusCodes map[string][]int
+
+func (s *statusCodes) decodeEnv(v string) error {
+	parsed, err := parseAcceptedStatusCodes(v)
+	if err != nil {
+		return err
+	}
+
+	*s = parsed
+
+	return nil
+}
+
+// checkOptions are values keyed by check, given as semicolon-separated check=value pairs in the environment.
+type checkOptions map[string]string
+
+func (c *checkOptions) decodeEnv(v string) error {
+	parsed, err := parseCheckOptions(v)
+	if err != nil {
+		return err
+	}
+
+	*c = parsed
+
+	return nil
+}
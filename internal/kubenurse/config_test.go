@@ -0,0 +1,151 @@
+package kubenurse
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	return path
+}
+
+func TestLoadOptions(t *testing.T) {
+	r := require.New(t)
+
+	opts, err := LoadOptions(writeConfig(t, `
+check_interval: 10s
+neighbour_limit: 20
+neighbour_fraction: 0.05
+check_dns_protocols: true
+check_me_ingress: false
+apiserver_endpoints:
+  - 10.0.0.1:6443
+  - 10.0.0.2:6443
+histogram_buckets: [0.001, 0.01, 1]
+health_weights:
+  me_ingress: 0.5
+accepted_status:
+  me_ingress: [200, 204]
+`))
+	r.NoError(err)
+	r.Equal(Duration(10*time.Second), opts.CheckInterval)
+	r.Equal(20, opts.NeighbourLimit)
+	r.InEpsilon(0.05, opts.NeighbourFraction, 1e-9)
+	r.True(opts.CheckDNSProtocols)
+	r.False(opts.CheckMeIngress)
+	r.Equal([]string{"10.0.0.1:6443", "10.0.0.2:6443"}, opts.APIServerEndpoints)
+	r.Equal([]float64{0.001, 0.01, 1}, opts.HistogramBuckets)
+	r.Equal(weights{"me_ingress": 0.5}, opts.HealthWeights)
+	r.Equal(statusCodes{"me_ingress": {200, 204}}, opts.AcceptedStatus)
+
+	// the defaults are kept for the options which are not set
+	r.True(opts.CheckMeService)
+	r.Equal(Duration(5*time.Second), opts.ShutdownDuration)
+
+	// json is yaml
+	opts, err = LoadOptions(writeConfig(t, `{"neighbour_limit": 5}`))
+	r.NoError(err)
+	r.Equal(5, opts.NeighbourLimit)
+
+	// null keeps the default
+	opts, err = LoadOptions(writeConfig(t, "neighbour_limit: null\ncheck_interval: null\n"))
+	r.NoError(err)
+	r.Equal(10, opts.NeighbourLimit)
+	r.Equal(Duration(defaultCheckInterval), opts.CheckInterval)
+
+	opts, err = LoadOptions("")
+	r.NoError(err)
+	r.Equal(DefaultOptions(), opts)
+
+	_, err = LoadOptions(filepath.Join(t.TempDir(), "missing.yaml"))
+	r.Error(err)
+}
+
+func TestLoadOptionsErrors(t *testing.T) {
+	r := require.New(t)
+
+	_, err := LoadOptions(writeConfig(t, "neighbour_limt: 5\n"))
+	r.ErrorContains(err, `unknown option "neighbour_limt"`)
+
+	_, err = LoadOptions(writeConfig(t, "neighbour_limit: many\n"))
+	r.ErrorContains(err, `option "neighbour_limit"`)
+
+	_, err = LoadOptions(writeConfig(t, "check_interval: 10\n"))
+	r.ErrorContains(err, `option "check_interval"`)
+
+	_, err = LoadOptions(writeConfig(t, "check_interval: 10x\n"))
+	r.ErrorContains(err, `option "check_interval"`)
+
+	// null keeps the default of the strings too
+	opts, err := LoadOptions(writeConfig(t, "service_port: null\n"))
+	r.NoError(err)
+	r.Equal("8080", opts.ServicePort)
+
+	_, err = LoadOptions(writeConfig(t, "neighbour_limit: 5\nneighbour_limit: 6\n"))
+	r.Error(err)
+
+	_, err = LoadOptions(writeConfig(t, "neighbour_fraction: 2\nneighbour_scheme: ftp\n"))
+	r.ErrorContains(err, "neighbour_fraction")
+	r.ErrorContains(err, "neighbour_scheme")
+
+	_, err = LoadOptions(writeConfig(t, "accepted_status:\n  me_ingress: [42]\n"))
+	r.ErrorContains(err, "invalid status code 42")
+}
+
+func TestLoadOptionsEnv(t *testing.T) {
+	r := require.New(t)
+
+	path := writeConfig(t, "neighbour_limit: 20\nneighbour_filter: app=kubenurse\ncheck_me_ingress: false\n")
+
+	// environment variables override the file, and are not modified
+	t.Setenv("KUBENURSE_NEIGHBOUR_LIMIT", "5")
+	t.Setenv("KUBENURSE_CHECK_ME_SERVICE", "false")
+	t.Setenv("KUBENURSE_HEALTH_WEIGHTS", "me_ingress=0.5,neighbourhood=3")
+	t.Setenv("KUBENURSE_BODY_CONTAINS", "me_ingress=alwayshappy")
+	t.Setenv("KUBENURSE_CRITICAL_CHECKS", "me_ingress, me_service")
+
+	opts, err := LoadOptions(path)
+	r.NoError(err)
+	r.Equal(5, opts.NeighbourLimit)
+	r.Equal("app=kubenurse", opts.NeighbourFilter)
+	r.False(opts.CheckMeIngress)
+	r.False(opts.CheckMeService)
+	r.Equal(weights{"me_ingress": 0.5, "neighbourhood": 3}, opts.HealthWeights)
+	r.Equal(checkOptions{"me_ingress": "alwayshappy"}, opts.BodyContains)
+	r.Equal([]string{"me_ingress", "me_service"}, opts.CriticalChecks)
+
+	_, ok := os.LookupEnv("KUBENURSE_NEIGHBOUR_FILTER")
+	r.False(ok)
+
+	t.Setenv("KUBENURSE_NEIGHBOUR_LIMIT", "many")
+
+	_, err = LoadOptions(path)
+	r.ErrorContains(err, "parse KUBENURSE_NEIGHBOUR_LIMIT")
+
+	t.Setenv("KUBENURSE_NEIGHBOUR_LIMIT", "5")
+	t.Setenv("KUBENURSE_NEIGHBOUR_PAGE_SIZE", "100")
+
+	_, err = LoadOptions(path)
+	r.ErrorContains(err, "KUBENURSE_USE_CACHE=false")
+}
+
+func TestNewConfigFile(t *testing.T) {
+	r := require.New(t)
+
+	t.Setenv("KUBENURSE_CONFIG", writeConfig(t, "neighbour_limit: 20\n"))
+
+	kubenurse, err := New(context.Background(), fake.NewFakeClient())
+	r.NoError(err)
+	r.Equal(20, kubenurse.checker.NeighbourLimit)
+}
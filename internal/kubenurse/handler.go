@@ -1,9 +1,12 @@
 package kubenurse
 
 import (
+	"context"
 	"encoding/json"
+	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/postfinance/kubenurse/internal/servicecheck"
 )
@@ -13,7 +16,10 @@ func (s *Server) readyHandler() func(w http.ResponseWriter, r *http.Request) {
 		s.mu.Lock()
 		defer s.mu.Unlock()
 
-		if s.ready {
+		// not ready until the startup delay of the scheduled checker has passed
+		starting := !s.startedAt.IsZero() && time.Since(s.startedAt) < s.checker.StartupDelay
+
+		if s.ready && !starting {
 			w.WriteHeader(http.StatusOK)
 		} else {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -21,6 +27,29 @@ func (s *Server) readyHandler() func(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) alwaysHappyHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// log the request id of checking kubenurses, so that failed checks can be correlated
+		if requestID := r.Header.Get(servicecheck.RequestIDHeader); requestID != "" {
+			log.Printf("alwayshappy request_id=%s from %s", requestID, r.RemoteAddr)
+			w.Header().Set(servicecheck.RequestIDHeader, requestID)
+		}
+
+		// announce the version, the checking neighbours only rely on the status code
+		w.Header().Set(servicecheck.VersionHeader, s.checker.Version)
+
+		s.mu.Lock()
+		shuttingDown := !s.ready // ready is only unset by Shutdown
+		s.mu.Unlock()
+
+		// tell the checking neighbours that we are going away, so that they skip their check
+		if s.shutdownDeregister && shuttingDown {
+			w.Header().Set(servicecheck.ShuttingDownHeader, "true")
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		}
+	}
+}
+
 func (s *Server) aliveHandler() func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		type Output struct {
@@ -38,7 +67,7 @@ func (s *Server) aliveHandler() func(w http.ResponseWriter, r *http.Request) {
 			Neighbourhood      []*servicecheck.Neighbour `json:"neighbourhood"`
 		}
 
-		res := s.checker.LastCheckResult
+		res := s.checker.LastResult()
 		if res == nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
@@ -56,9 +85,102 @@ func (s *Server) aliveHandler() func(w http.ResponseWriter, r *http.Request) {
 		}
 		out.Hostname, _ = os.Hostname()
 
+		if s.unhealthy(res) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+
 		// Generate output output
 		enc := json.NewEncoder(w)
 		enc.SetIndent("", " ")
 		_ = enc.Encode(out)
 	}
 }
+
+// selftestMargin is left between the end of a selftest run and the write timeout, to send the result.
+const selftestMargin = time.Second
+
+func (s *Server) selftestHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		// run all checks now, the result also replaces the one served by /alive. The run must end before the
+		// write timeout of the server, else the connection is closed without any response
+		ctx, cancel := context.WithTimeout(r.Context(), s.http.WriteTimeout-selftestMargin)
+		defer cancel()
+
+		res, hadError, err := s.checker.RunContext(ctx)
+		if err != nil {
+			http.Error(w, "selftest did not start: "+err.Error(), http.StatusGatewayTimeout)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		switch {
+		case ctx.Err() != nil:
+			w.WriteHeader(http.StatusGatewayTimeout)
+		case hadError:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", " ")
+		_ = enc.Encode(res)
+	}
+}
+
+func (s *Server) configHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		type Output struct {
+			*Options
+
+			// the location of the API Server is not an option, it is given by kubernetes
+			KubernetesServiceHost string `json:"kubernetes_service_host"`
+			KubernetesServicePort string `json:"kubernetes_service_port"`
+		}
+
+		out := Output{
+			Options:               s.opts.redacted(),
+			KubernetesServiceHost: s.checker.KubernetesServiceHost,
+			KubernetesServicePort: s.checker.KubernetesServicePort,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", " ")
+		_ = enc.Encode(out)
+	}
+}
+
+func (s *Server) neighboursHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", " ")
+		_ = enc.Encode(s.checker.SelectedNeighbours())
+	}
+}
+
+func (s *Server) resetConnectionsHandler() func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+			return
+		}
+
+		log.Printf("closing idle connections, requested by %s", r.RemoteAddr)
+		s.checker.ResetConnections()
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
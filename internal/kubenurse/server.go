@@ -3,10 +3,13 @@ package kubenurse
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"regexp"
+	"runtime"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
@@ -28,47 +31,42 @@ type Server struct {
 
 	checker *servicecheck.Checker
 
+	// options the server was created with, served by /config
+	opts *Options
+
 	// Configuration options
 	useTLS        bool
+	certFile      string
+	certKey       string
 	checkInterval time.Duration
 	// If we want to consider kubenurses on unschedulable nodes
 	allowUnschedulable bool
-
-	// Mutex to protect ready flag
-	mu    *sync.Mutex
-	ready bool
+	// If /alwayshappy should fail during the shutdown, so that neighbours skip their checks
+	shutdownDeregister bool
+	// Number (>= 1) or fraction (< 1) of failed checks from which /alive reports unhealthy, disabled if 0
+	unhealthyThreshold float64
+
+	// Mutex to protect ready flag and start time
+	mu        *sync.Mutex
+	ready     bool
+	startedAt time.Time
 }
 
-// New creates a new kubenurse server. The server can be configured with the following environment variables:
-// * KUBENURSE_USE_TLS
-// * KUBENURSE_ALLOW_UNSCHEDULABLE
-// * KUBENURSE_INGRESS_URL
-// * KUBENURSE_SERVICE_URL
-// * KUBERNETES_SERVICE_HOST
-// * KUBERNETES_SERVICE_PORT
-// * KUBENURSE_NAMESPACE
-// * KUBENURSE_NEIGHBOUR_FILTER
-// * KUBENURSE_NEIGHBOUR_LIMIT
-// * KUBENURSE_SHUTDOWN_DURATION
-// * KUBENURSE_CHECK_API_SERVER_DIRECT
-// * KUBENURSE_CHECK_API_SERVER_DNS
-// * KUBENURSE_CHECK_ME_INGRESS
-// * KUBENURSE_CHECK_ME_SERVICE
-// * KUBENURSE_CHECK_NEIGHBOURHOOD
-// * KUBENURSE_CHECK_INTERVAL
-func New(ctx context.Context, c client.Client) (*Server, error) { //nolint:funlen // TODO: use a flag parsing library (e.g. ff) to reduce complexity
-	mux := http.NewServeMux()
-
-	checkInterval := defaultCheckInterval
+// New creates a new kubenurse server configured with the file given in KUBENURSE_CONFIG, if any, and the
+// KUBENURSE_* environment variables, see LoadOptions.
+func New(ctx context.Context, c client.Client) (*Server, error) {
+	opts, err := LoadOptions(os.Getenv("KUBENURSE_CONFIG"))
+	if err != nil {
+		return nil, err
+	}
 
-	if v, ok := os.LookupEnv("KUBENURSE_CHECK_INTERVAL"); ok {
-		var err error
-		checkInterval, err = time.ParseDuration(v)
+	return NewWithOptions(ctx, c, opts)
+}
 
-		if err != nil {
-			return nil, err
-		}
-	}
+// NewWithOptions creates a new kubenurse server configured with opts. The location of the cluster and of the pod
+// are still read from the KUBERNETES_SERVICE_HOST, KUBERNETES_SERVICE_PORT and POD_NAMESPACE environment variables.
+func NewWithOptions(ctx context.Context, c client.Client, opts *Options) (*Server, error) { //nolint:funlen // the options are mapped one by one
+	mux := http.NewServeMux()
 
 	server := &Server{
 		http: http.Server{
@@ -85,11 +83,14 @@ func New(ctx context.Context, c client.Client) (*Server, error) { //nolint:funle
 			WriteTimeout:      10 * time.Second,
 			IdleTimeout:       120 * time.Second,
 		},
-
-		//nolint:goconst // No need to make "true" a constant in my opinion, readability is better like this.
-		useTLS:             os.Getenv("KUBENURSE_USE_TLS") == "true",
-		allowUnschedulable: os.Getenv("KUBENURSE_ALLOW_UNSCHEDULABLE") == "true",
-		checkInterval:      checkInterval,
+		opts:               opts,
+		useTLS:             opts.UseTLS,
+		certFile:           opts.CertFile,
+		certKey:            opts.CertKey,
+		allowUnschedulable: opts.AllowUnschedulable,
+		shutdownDeregister: opts.ShutdownDeregister,
+		unhealthyThreshold: opts.UnhealthyThreshold,
+		checkInterval:      time.Duration(opts.CheckInterval),
 		mu:                 new(sync.Mutex),
 		ready:              true,
 	}
@@ -98,76 +99,158 @@ func New(ctx context.Context, c client.Client) (*Server, error) { //nolint:funle
 	promRegistry.MustRegister(
 		collectors.NewGoCollector(),
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		buildInfoGauge(),
 	)
 
-	var histogramBuckets []float64
+	histogramBuckets := opts.HistogramBuckets
 
-	if bucketsString := os.Getenv("KUBENURSE_HISTOGRAM_BUCKETS"); bucketsString != "" {
-		for _, bucketStr := range strings.Split(bucketsString, ",") {
-			bucket, e := strconv.ParseFloat(bucketStr, 64)
-
-			if e != nil {
-				log.Fatalf("couldn't parse one of the custom histogram buckets. error:\n%v", e)
-			}
+	if histogramBuckets == nil {
+		var err error
 
-			histogramBuckets = append(histogramBuckets, bucket)
+		histogramBuckets, err = histogramPreset(opts.HistogramPreset)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	if histogramBuckets == nil {
-		histogramBuckets = prometheus.DefBuckets
-	}
-
 	// setup checker
-	chk, err := servicecheck.New(ctx, c, promRegistry, server.allowUnschedulable, 1*time.Second, histogramBuckets)
+	chk, err := servicecheck.New(ctx, c, promRegistry, server.allowUnschedulable, 1*time.Second, histogramBuckets,
+		servicecheck.WithSettings(opts.settings()))
 	if err != nil {
 		return nil, err
 	}
 
-	shutdownDuration := 5 * time.Second
+	chk.ShutdownDuration = time.Duration(opts.ShutdownDuration)
+	chk.SuccessWindow = time.Duration(opts.SuccessWindow)
 
-	if v, ok := os.LookupEnv("KUBENURSE_SHUTDOWN_DURATION"); ok {
-		shutdownDuration, err = time.ParseDuration(v)
+	for name, weight := range opts.HealthWeights {
+		chk.HealthWeights[name] = weight
+	}
 
-		if err != nil {
-			return nil, err
+	chk.RunDeadline = time.Duration(opts.RunDeadline)
+	chk.FailFast = opts.FailFast
+
+	if len(opts.CriticalChecks) > 0 {
+		chk.CriticalChecks = make(map[string]bool)
+
+		for _, name := range opts.CriticalChecks {
+			chk.CriticalChecks[name] = true
 		}
 	}
 
-	chk.ShutdownDuration = shutdownDuration
-	chk.KubenurseIngressURL = os.Getenv("KUBENURSE_INGRESS_URL")
-	chk.KubenurseServiceURL = os.Getenv("KUBENURSE_SERVICE_URL")
+	chk.StartupDelay = time.Duration(opts.StartupDelay)
+	// the first run is done on start unless disabled, so that /alive and the metrics are populated promptly
+	chk.RunOnStart = opts.RunOnStart
+
+	chk.KubenurseIngressURL = opts.IngressURL
+	chk.KubenurseServiceURL = opts.ServiceURL
+
+	// derive the service url from the service name and the namespace of the pod (downward API)
+	if svc := opts.ServiceName; chk.KubenurseServiceURL == "" && svc != "" {
+		ns := os.Getenv("POD_NAMESPACE")
+		if ns == "" {
+			return nil, errors.New("POD_NAMESPACE must be set to derive the service url from KUBENURSE_SERVICE_NAME")
+		}
+
+		chk.KubenurseServiceURL = fmt.Sprintf("http://%s.%s.svc.cluster.local:%s", svc, ns, opts.ServicePort)
+	}
 	chk.KubernetesServiceHost = os.Getenv("KUBERNETES_SERVICE_HOST")
 	chk.KubernetesServicePort = os.Getenv("KUBERNETES_SERVICE_PORT")
-	chk.KubenurseNamespace = os.Getenv("KUBENURSE_NAMESPACE")
-	chk.NeighbourFilter = os.Getenv("KUBENURSE_NEIGHBOUR_FILTER")
-	neighLimit := os.Getenv("KUBENURSE_NEIGHBOUR_LIMIT")
+	chk.KubenurseNamespace = opts.Namespace
 
-	if neighLimit != "" {
-		chk.NeighbourLimit, err = strconv.Atoi(neighLimit)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		chk.NeighbourLimit = 10
+	// the endpoints of the service are looked up in the namespace of the kubenurse pods
+	if opts.CheckServiceEndpoints {
+		chk.CheckServiceEndpoints = true
+		chk.KubenurseServiceName = opts.ServiceName
+		chk.KubenurseServiceNamespace = chk.KubenurseNamespace
+	}
+
+	chk.NeighbourFilter = opts.NeighbourFilter
+	chk.NeighbourLimit = opts.NeighbourLimit
+	chk.NeighbourCheckAll = opts.NeighbourCheckAll
+	chk.NeighbourIncludeSelf = opts.NeighbourIncludeSelf
+	chk.NeighbourFraction = opts.NeighbourFraction
+	chk.NeighbourFractionMin = opts.NeighbourFractionMin
+	chk.NeighbourFractionMax = opts.NeighbourFractionMax
+	chk.ExposeSelectedNeighbours = opts.SelectedNeighbourMetric
+	chk.NeighbourScheme = opts.NeighbourScheme
+
+	if opts.NeighbourPort != 0 {
+		chk.NeighbourPort = strconv.Itoa(opts.NeighbourPort)
+	}
+
+	chk.NeighbourUseDNS = opts.NeighbourUseDNS
+	chk.NeighbourPageSize = opts.NeighbourPageSize
+	chk.NeighbourTimeout = time.Duration(opts.NeighbourTimeout)
+	chk.NeighbourConcurrency = opts.NeighbourConcurrency
+
+	if opts.SelfCheckPath != "" {
+		chk.SelfCheckPath = opts.SelfCheckPath
+	}
+
+	chk.SkipCheckAPIServerDirect = !opts.CheckAPIServerDirect
+	chk.SkipCheckAPIServerDNS = !opts.CheckAPIServerDNS
+	chk.DualStackAPIServer = opts.DualStackAPIServer
+	chk.SkipCheckMeIngress = !opts.CheckMeIngress
+	chk.SkipCheckMeService = !opts.CheckMeService
+	chk.SkipCheckNeighbourhood = !opts.CheckNeighbourhood
+	// the dns protocol checks are disabled unless explicitly enabled
+	chk.SkipCheckDNSProtocols = !opts.CheckDNSProtocols
+
+	if opts.TokenPath != "" {
+		chk.TokenPath = opts.TokenPath
+	}
+
+	chk.APIServerEndpoints = opts.APIServerEndpoints
+
+	if opts.DNSCheckHost != "" {
+		chk.DNSCheckHost = opts.DNSCheckHost
 	}
 
-	//nolint:goconst // No need to make "false" a constant in my opinion, readability is better like this.
-	chk.SkipCheckAPIServerDirect = os.Getenv("KUBENURSE_CHECK_API_SERVER_DIRECT") == "false"
-	chk.SkipCheckAPIServerDNS = os.Getenv("KUBENURSE_CHECK_API_SERVER_DNS") == "false"
-	chk.SkipCheckMeIngress = os.Getenv("KUBENURSE_CHECK_ME_INGRESS") == "false"
-	chk.SkipCheckMeService = os.Getenv("KUBENURSE_CHECK_ME_SERVICE") == "false"
-	chk.SkipCheckNeighbourhood = os.Getenv("KUBENURSE_CHECK_NEIGHBOURHOOD") == "false"
+	chk.InternetCheckURL = opts.InternetCheckURL
+
+	// the checks routed through the SOCKS5 proxy of KUBENURSE_SOCKS_PROXY, none by default
+	chk.SOCKSChecks = make(map[string]bool)
+
+	for _, name := range opts.SOCKSChecks {
+		chk.SOCKSChecks[name] = true
+	}
 
 	chk.UseTLS = server.useTLS
+	chk.Version, _ = buildVersion()
+	chk.AcceptedStatusCodes = opts.AcceptedStatus
+
+	chk.BodyMatchers, err = parseBodyMatchers(opts.BodyContains, opts.BodyRegex)
+	if err != nil {
+		return nil, err
+	}
+
+	// the result of every run in which a check transitioned to failure is posted to the webhook
+	chk.WebhookURL = opts.WebhookURL
+	chk.WebhookMinInterval = time.Duration(opts.WebhookMinInterval)
 
 	server.checker = chk
 
 	// setup http routes
 	mux.HandleFunc("/ready", server.readyHandler())
 	mux.HandleFunc("/alive", server.aliveHandler())
-	mux.HandleFunc("/alwayshappy", func(http.ResponseWriter, *http.Request) {})
-	mux.Handle("/metrics", promhttp.HandlerFor(promRegistry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/config", server.configHandler())
+	mux.HandleFunc("/neighbours", server.neighboursHandler())
+	mux.HandleFunc("/alwayshappy", server.alwaysHappyHandler())
+	// the checks of other kubenurses are sent to the configured self check path, which must be served as well
+	if chk.SelfCheckPath != "/alwayshappy" {
+		mux.HandleFunc(chk.SelfCheckPath, server.alwaysHappyHandler())
+	}
+	// admin endpoints change the state of the checker or run the checks on demand, they are opt-in
+	if opts.AdminEndpoints {
+		mux.HandleFunc("/admin/reset-connections", server.resetConnectionsHandler())
+		mux.HandleFunc("/selftest", server.selftestHandler())
+	}
+
+	mux.Handle("/metrics", promhttp.HandlerFor(promRegistry, promhttp.HandlerOpts{
+		// OpenMetrics is only served if requested by the scraper, classic text format stays the default
+		EnableOpenMetrics: opts.OpenMetrics,
+	}))
 	mux.Handle("/", http.RedirectHandler("/alive", http.StatusMovedPermanently))
 
 	return server, nil
@@ -180,6 +263,10 @@ func (s *Server) Run() error {
 		errc = make(chan error, 2) // max two errors can happen
 	)
 
+	s.mu.Lock()
+	s.startedAt = time.Now()
+	s.mu.Unlock()
+
 	wg.Add(1)
 
 	go func() {
@@ -207,8 +294,8 @@ func (s *Server) Run() error {
 			defer wg.Done()
 
 			if err := s.https.ListenAndServeTLS(
-				os.Getenv("KUBENURSE_CERT_FILE"),
-				os.Getenv("KUBENURSE_CERT_KEY"),
+				s.certFile,
+				s.certKey,
 			); err != nil {
 				if err != http.ErrServerClosed {
 					errc <- fmt.Errorf("listen https: %w", err)
@@ -230,7 +317,8 @@ func (s *Server) Run() error {
 	return nil
 }
 
-// Shutdown disables the readiness probe and then gracefully halts the kubenurse http/https server(s).
+// Shutdown disables the readiness probe (and /alwayshappy if configured) and then gracefully halts the
+// kubenurse http/https server(s).
 func (s *Server) Shutdown(ctx context.Context) error {
 	s.mu.Lock()
 	s.ready = false
@@ -257,3 +345,133 @@ func (s *Server) Shutdown(ctx context.Context) error {
 
 	return nil
 }
+
+// parseCheckOptions parses per-check options given as semicolon-separated check=value pairs,
+// e.g. "me_ingress=foo;api_server_dns=bar".
+func parseCheckOptions(v string) (map[string]string, error) {
+	opts := make(map[string]string)
+
+	if v == "" {
+		return opts, nil
+	}
+
+	for _, pair := range strings.Split(v, ";") {
+		check, value, found := strings.Cut(pair, "=")
+		if !found || strings.TrimSpace(check) == "" {
+			return nil, fmt.Errorf("invalid option %q, expected check=value", pair)
+		}
+
+		opts[strings.TrimSpace(check)] = value
+	}
+
+	return opts, nil
+}
+
+// unhealthy returns true if the failed checks of the result reach the unhealthyThreshold, either as number of
+// checks or as fraction of the performed checks.
+func (s *Server) unhealthy(res *servicecheck.Result) bool {
+	if s.unhealthyThreshold <= 0 {
+		return false
+	}
+
+	failed, total := res.FailedChecks()
+
+	if s.unhealthyThreshold < 1 {
+		return total > 0 && float64(failed)/float64(total) >= s.unhealthyThreshold
+	}
+
+	return float64(failed) >= s.unhealthyThreshold
+}
+
+// histogramPreset returns the buckets of the named preset, "default" (the default prometheus buckets) if empty.
+// The "low_latency" preset adds sub-millisecond buckets for checks within a node or zone.
+func histogramPreset(name string) ([]float64, error) {
+	switch name {
+	case "", "default":
+		return prometheus.DefBuckets, nil
+	case "low_latency":
+		return []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, nil
+	default:
+		return nil, fmt.Errorf("invalid KUBENURSE_HISTOGRAM_PRESET %q, must be default or low_latency", name)
+	}
+}
+
+// buildInfoGauge returns the kubenurse_build_info gauge, which is always 1 and labelled with the version and
+// commit of the binary, as embedded by the go toolchain, and the go version it was built with.
+func buildInfoGauge() prometheus.Gauge {
+	version, commit := buildVersion()
+
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "kubenurse",
+		Name:      "build_info",
+		Help:      "Always 1, labelled with the version and commit of kubenurse and the go version it was built with",
+		ConstLabels: prometheus.Labels{
+			"version":   version,
+			"commit":    commit,
+			"goversion": runtime.Version(),
+		},
+	})
+	g.Set(1)
+
+	return g
+}
+
+// buildVersion returns the version and commit of the binary, as embedded by the go toolchain.
+func buildVersion() (version, commit string) {
+	version, commit = "unknown", "unknown"
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		version = bi.Main.Version
+
+		for _, setting := range bi.Settings {
+			if setting.Key == "vcs.revision" {
+				commit = setting.Value
+			}
+		}
+	}
+
+	return version, commit
+}
+
+// parseAcceptedStatusCodes returns the accepted status codes of the checks, given as comma-separated lists.
+func parseAcceptedStatusCodes(v string) (map[string][]int, error) {
+	opts, err := parseCheckOptions(v)
+	if err != nil {
+		return nil, err
+	}
+
+	accepted := make(map[string][]int, len(opts))
+
+	for check, codes := range opts {
+		for _, codeStr := range strings.Split(codes, ",") {
+			code, err := strconv.Atoi(strings.TrimSpace(codeStr))
+			if err != nil || code < 100 || code > 599 {
+				return nil, fmt.Errorf("invalid status code %q for %s", codeStr, check)
+			}
+
+			accepted[check] = append(accepted[check], code)
+		}
+	}
+
+	return accepted, nil
+}
+
+// parseBodyMatchers returns the body matchers of the checks, from substrings and regular expressions.
+func parseBodyMatchers(contains, regex map[string]string) (map[string]servicecheck.BodyMatcher, error) {
+	matchers := make(map[string]servicecheck.BodyMatcher)
+
+	for check, substr := range contains {
+		matchers[check] = servicecheck.ContainsMatcher(substr)
+	}
+
+	for check, expr := range regex {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid body_regex for %s: %w", check, err)
+		}
+
+		matchers[check] = re
+	}
+
+	return matchers, nil
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"testing"
 
+	"github.com/postfinance/kubenurse/internal/servicecheck"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/require"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 )
@@ -36,3 +38,129 @@ func TestCombined(t *testing.T) {
 		r.NoError(err)
 	})
 }
+
+func TestParseBodyMatchers(t *testing.T) {
+	r := require.New(t)
+
+	matchers, err := parseBodyMatchers(
+		map[string]string{"me_ingress": "alwayshappy", "api_server_dns": `"gitVersion"`},
+		map[string]string{"api_server_direct": `"major":\s*"1"`},
+	)
+	r.NoError(err)
+	r.Len(matchers, 3)
+
+	r.True(matchers["api_server_dns"].Match([]byte(`{"gitVersion": "v1.29.2"}`)))
+	r.False(matchers["api_server_dns"].Match([]byte(`{}`)))
+	r.True(matchers["api_server_direct"].Match([]byte(`{"major": "1"}`)))
+	r.False(matchers["api_server_direct"].Match([]byte(`{"major": "2"}`)))
+
+	_, err = parseBodyMatchers(nil, map[string]string{"me_ingress": "["})
+	r.Error(err)
+}
+
+func TestParseAcceptedStatusCodes(t *testing.T) {
+	r := require.New(t)
+
+	accepted, err := parseAcceptedStatusCodes("me_ingress=200,204,302;api_server_direct=200, 401")
+	r.NoError(err)
+	r.Equal(map[string][]int{
+		"me_ingress":        {200, 204, 302},
+		"api_server_direct": {200, 401},
+	}, accepted)
+
+	_, err = parseAcceptedStatusCodes("me_ingress=ok")
+	r.Error(err)
+
+	_, err = parseAcceptedStatusCodes("me_ingress=42")
+	r.Error(err)
+}
+
+func TestUnhealthy(t *testing.T) {
+	r := require.New(t)
+
+	res := &servicecheck.Result{
+		APIServerDirect: "ok", APIServerDNS: "ok", MeIngress: "502 Bad Gateway", MeService: "ok",
+		NeighbourhoodState: "skipped",
+	}
+
+	r.False((&Server{}).unhealthy(res))
+	r.True((&Server{unhealthyThreshold: 1}).unhealthy(res))
+	r.False((&Server{unhealthyThreshold: 2}).unhealthy(res))
+	r.True((&Server{unhealthyThreshold: 0.25}).unhealthy(res))
+	r.False((&Server{unhealthyThreshold: 0.5}).unhealthy(res))
+}
+
+func TestHistogramPreset(t *testing.T) {
+	r := require.New(t)
+
+	buckets, err := histogramPreset("")
+	r.NoError(err)
+	r.Equal(prometheus.DefBuckets, buckets)
+
+	buckets, err = histogramPreset("low_latency")
+	r.NoError(err)
+	r.Less(buckets[0], 0.001)
+	r.IsIncreasing(buckets)
+
+	_, err = histogramPreset("fast")
+	r.Error(err)
+}
+
+func TestNeighbourPageSizeRequiresUncachedClient(t *testing.T) {
+	r := require.New(t)
+
+	t.Setenv("KUBENURSE_NEIGHBOUR_PAGE_SIZE", "100")
+
+	_, err := New(context.Background(), fake.NewFakeClient())
+	r.ErrorContains(err, "KUBENURSE_USE_CACHE=false")
+
+	t.Setenv("KUBENURSE_USE_CACHE", "false")
+
+	kubenurse, err := New(context.Background(), fake.NewFakeClient())
+	r.NoError(err)
+	r.Equal(int64(100), kubenurse.checker.NeighbourPageSize)
+}
+
+func TestRunOnStartDefault(t *testing.T) {
+	r := require.New(t)
+
+	kubenurse, err := New(context.Background(), fake.NewFakeClient())
+	r.NoError(err)
+	r.True(kubenurse.checker.RunOnStart)
+
+	t.Setenv("KUBENURSE_RUN_ON_START", "false")
+
+	kubenurse, err = New(context.Background(), fake.NewFakeClient())
+	r.NoError(err)
+	r.False(kubenurse.checker.RunOnStart)
+}
+
+func TestServiceURLFromName(t *testing.T) {
+	r := require.New(t)
+
+	t.Setenv("KUBENURSE_SERVICE_NAME", "kubenurse")
+	t.Setenv("POD_NAMESPACE", "")
+
+	_, err := New(context.Background(), fake.NewFakeClient())
+	r.ErrorContains(err, "POD_NAMESPACE must be set")
+
+	t.Setenv("POD_NAMESPACE", "monitoring")
+
+	kubenurse, err := New(context.Background(), fake.NewFakeClient())
+	r.NoError(err)
+	r.Equal("http://kubenurse.monitoring.svc.cluster.local:8080", kubenurse.checker.KubenurseServiceURL)
+
+	t.Setenv("KUBENURSE_SERVICE_PORT", "8443")
+
+	kubenurse, err = New(context.Background(), fake.NewFakeClient())
+	r.NoError(err)
+	r.Equal("http://kubenurse.monitoring.svc.cluster.local:8443", kubenurse.checker.KubenurseServiceURL)
+
+	// an explicit url is kept, and the namespace is not needed
+	t.Setenv("KUBENURSE_SERVICE_URL", "http://kubenurse:8080")
+	t.Setenv("POD_NAMESPACE", "")
+
+	kubenurse, err = New(context.Background(), fake.NewFakeClient())
+	r.NoError(err)
+	r.Equal("http://kubenurse:8080", kubenurse.checker.KubenurseServiceURL)
+}
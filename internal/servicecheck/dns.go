@@ -0,0 +1,52 @@
+package servicecheck
+
+import (
+	"context"
+	"net"
+)
+
+const defaultDNSCheckHost = "kubernetes.default.svc.cluster.local"
+
+// DNSUDP resolves DNSCheckHost with the cluster DNS, forcing the query over UDP
+func (c *Checker) DNSUDP(ctx context.Context) (string, error) {
+	return c.dnsLookup(ctx, "udp")
+}
+
+// DNSTCP resolves DNSCheckHost with the cluster DNS, forcing the query over TCP
+func (c *Checker) DNSTCP(ctx context.Context) (string, error) {
+	return c.dnsLookup(ctx, "tcp")
+}
+
+// dnsLookup performs the resolution of DNSCheckHost with the resolver of the given network.
+func (c *Checker) dnsLookup(ctx context.Context, network string) (string, error) {
+	if c.SkipCheckDNSProtocols {
+		return skippedStr, nil
+	}
+
+	// the resolver has no timeout of its own, use the same one as the http client
+	ctx, cancel := context.WithTimeout(ctx, c.httpClient.Timeout)
+	defer cancel()
+
+	if _, err := c.dnsResolver(network).LookupHost(ctx, c.DNSCheckHost); err != nil {
+		return err.Error(), err
+	}
+
+	return okStr, nil
+}
+
+// dnsResolver returns the pure go resolver, whose connections to the nameserver always use the given network.
+func (c *Checker) dnsResolver(network string) *net.Resolver {
+	dialer := *c.dialer
+
+	// the local address of the dialer must match the forced network
+	if addr, ok := dialer.LocalAddr.(*net.TCPAddr); ok && network == "udp" {
+		dialer.LocalAddr = &net.UDPAddr{IP: addr.IP}
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, address string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
@@ -0,0 +1,50 @@
+package servicecheck
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestDNSResolverNetwork(t *testing.T) {
+	r := require.New(t)
+
+	checker, err := New(context.Background(), fake.NewFakeClient(), prometheus.NewRegistry(), false, 0, prometheus.DefBuckets)
+	r.NoError(err)
+
+	// a source address configured for tcp is converted for udp
+	checker.dialer.LocalAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	r.NoError(err)
+
+	defer udp.Close()
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	r.NoError(err)
+
+	defer tcp.Close()
+
+	// the go resolver dials "udp" first and retries over "tcp" on truncation, the forced network is used anyway
+	conn, err := checker.dnsResolver("udp").Dial(context.Background(), "tcp", udp.LocalAddr().String())
+	r.NoError(err)
+	r.IsType(&net.UDPAddr{}, conn.LocalAddr())
+	r.Equal(udp.LocalAddr().String(), conn.RemoteAddr().String())
+	conn.Close()
+
+	conn, err = checker.dnsResolver("tcp").Dial(context.Background(), "udp", tcp.Addr().String())
+	r.NoError(err)
+	r.IsType(&net.TCPAddr{}, conn.LocalAddr())
+	r.Equal(tcp.Addr().String(), conn.RemoteAddr().String())
+	conn.Close()
+
+	checker.SkipCheckDNSProtocols = true
+
+	res, err := checker.DNSUDP(context.Background())
+	r.NoError(err)
+	r.Equal(skippedStr, res)
+}
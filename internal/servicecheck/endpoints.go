@@ -0,0 +1,129 @@
+package servicecheck
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// serviceEndpoint is a ready backend of the kubenurse service.
+type serviceEndpoint struct {
+	name string // name of the backing pod, or the address if the endpoint has no pod reference
+	url  string
+}
+
+// serviceEndpoints lists the ready endpoints of the kubenurse service from its EndpointSlices. The endpoints are
+// checked with the scheme of KubenurseServiceURL and the port of their EndpointSlice matching it, see
+// endpointSlicePort. On dual-stack clusters, the IPv6 endpoints are checked as well, their name has the suffix _v6.
+func (c *Checker) serviceEndpoints(ctx context.Context) ([]serviceEndpoint, error) {
+	scheme, servicePort := "http", ""
+
+	if u, err := url.Parse(c.KubenurseServiceURL); err == nil && u.Scheme != "" {
+		scheme, servicePort = u.Scheme, u.Port()
+	}
+
+	list := discoveryv1.EndpointSliceList{}
+
+	err := c.client.List(ctx, &list,
+		client.InNamespace(c.KubenurseServiceNamespace),
+		client.MatchingLabels{discoveryv1.LabelServiceName: c.KubenurseServiceName},
+	)
+	if err != nil {
+		return nil, fmt.Errorf("list endpointslices of service %s/%s: %w", c.KubenurseServiceNamespace, c.KubenurseServiceName, err)
+	}
+
+	var endpoints []serviceEndpoint
+
+	// a pod is listed once per address family, and may be listed in several slices of a family during updates
+	seen := make(map[string]bool)
+
+	for i := range list.Items {
+		slice := &list.Items[i]
+
+		var suffix string
+
+		switch slice.AddressType {
+		case discoveryv1.AddressTypeIPv4:
+		case discoveryv1.AddressTypeIPv6:
+			suffix = "_v6"
+		default: // FQDN endpoints are not backends of a service with a selector
+			continue
+		}
+
+		port, ok := endpointSlicePort(slice, scheme, servicePort)
+		if !ok {
+			return nil, fmt.Errorf("endpointslice %s has several ports, none with the number of the service url or named %s", slice.Name, scheme)
+		}
+
+		for _, ep := range slice.Endpoints {
+			// kube-proxy does not route to endpoints which are not ready
+			if len(ep.Addresses) == 0 || (ep.Conditions.Ready != nil && !*ep.Conditions.Ready) {
+				continue
+			}
+
+			name := ep.Addresses[0]
+			if ep.TargetRef != nil && ep.TargetRef.Kind == "Pod" {
+				name = ep.TargetRef.Name
+			}
+
+			name += suffix
+
+			if seen[name] {
+				continue
+			}
+
+			seen[name] = true
+
+			endpoints = append(endpoints, serviceEndpoint{
+				name: name,
+				url:  scheme + "://" + net.JoinHostPort(ep.Addresses[0], port) + c.SelfCheckPath,
+			})
+		}
+	}
+
+	return endpoints, nil
+}
+
+// endpointSlicePort returns the TCP port of the EndpointSlice to check with the scheme of the service url: the
+// port with the number of the service port (if the service port is also the target port), else the port named
+// after the scheme (e.g. "https"), else the only TCP port of the slice.
+func endpointSlicePort(slice *discoveryv1.EndpointSlice, scheme, servicePort string) (string, bool) {
+	var tcp []discoveryv1.EndpointPort
+
+	for _, p := range slice.Ports {
+		if p.Port == nil || (p.Protocol != nil && *p.Protocol != corev1.ProtocolTCP) {
+			continue
+		}
+
+		if strconv.Itoa(int(*p.Port)) == servicePort {
+			return servicePort, true
+		}
+
+		tcp = append(tcp, p)
+	}
+
+	for _, p := range tcp {
+		if p.Name != nil && *p.Name == scheme {
+			return strconv.Itoa(int(*p.Port)), true
+		}
+	}
+
+	if len(tcp) == 1 {
+		return strconv.Itoa(int(*tcp[0].Port)), true
+	}
+
+	return "", false
+}
+
+// serviceEndpoint returns a check of the kubenurse service endpoint at url.
+func (c *Checker) serviceEndpoint(u string) Check {
+	return func(ctx context.Context) (string, error) {
+		return c.doRequest(ctx, u)
+	}
+}
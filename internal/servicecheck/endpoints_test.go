@@ -0,0 +1,124 @@
+package servicecheck
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestServiceEndpoints(t *testing.T) {
+	r := require.New(t)
+
+	port, tcp, notReady := int32(8080), v1.ProtocolTCP, false
+
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "kubenurse-abcde",
+			Namespace: "kube-system",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "kubenurse"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Ports:       []discoveryv1.EndpointPort{{Port: &port, Protocol: &tcp}},
+		Endpoints: []discoveryv1.Endpoint{
+			{
+				Addresses: []string{"10.0.0.1"},
+				TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "kubenurse-1"},
+			},
+			{
+				Addresses:  []string{"10.0.0.2"},
+				Conditions: discoveryv1.EndpointConditions{Ready: &notReady},
+				TargetRef:  &v1.ObjectReference{Kind: "Pod", Name: "kubenurse-2"},
+			},
+			{
+				Addresses: []string{"10.0.0.3"},
+			},
+		},
+	}
+
+	// the slice of another service
+	other := slice.DeepCopy()
+	other.Name = "other-abcde"
+	other.Labels = map[string]string{discoveryv1.LabelServiceName: "other"}
+
+	fakeClient := fake.NewClientBuilder().WithObjects(slice, other).Build()
+
+	checker, err := New(context.Background(), fakeClient, prometheus.NewRegistry(), true, 0, prometheus.DefBuckets)
+	r.NoError(err)
+
+	checker.KubenurseServiceURL = "https://kubenurse.kube-system.svc.cluster.local:8443"
+	checker.KubenurseServiceName = "kubenurse"
+	checker.KubenurseServiceNamespace = "kube-system"
+
+	endpoints, err := checker.serviceEndpoints(context.Background())
+	r.NoError(err)
+	r.Equal([]serviceEndpoint{
+		{name: "kubenurse-1", url: "https://10.0.0.1:8080/alwayshappy"},
+		{name: "10.0.0.3", url: "https://10.0.0.3:8080/alwayshappy"},
+	}, endpoints)
+}
+
+func TestServiceEndpointsDualStack(t *testing.T) {
+	r := require.New(t)
+
+	metricsName, metricsPort, httpsName, httpsPort := "metrics", int32(9090), "https", int32(8443)
+	ports := []discoveryv1.EndpointPort{{Name: &metricsName, Port: &metricsPort}, {Name: &httpsName, Port: &httpsPort}}
+
+	slice := func(name string, family discoveryv1.AddressType, address string) *discoveryv1.EndpointSlice {
+		return &discoveryv1.EndpointSlice{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "kube-system",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "kubenurse"},
+			},
+			AddressType: family,
+			Ports:       ports,
+			Endpoints: []discoveryv1.Endpoint{{
+				Addresses: []string{address},
+				TargetRef: &v1.ObjectReference{Kind: "Pod", Name: "kubenurse-1"},
+			}},
+		}
+	}
+
+	fakeClient := fake.NewClientBuilder().WithObjects(
+		slice("kubenurse-v4", discoveryv1.AddressTypeIPv4, "10.0.0.1"),
+		slice("kubenurse-v6", discoveryv1.AddressTypeIPv6, "fd00::1"),
+	).Build()
+
+	checker, err := New(context.Background(), fakeClient, prometheus.NewRegistry(), true, 0, prometheus.DefBuckets)
+	r.NoError(err)
+
+	checker.KubenurseServiceName = "kubenurse"
+	checker.KubenurseServiceNamespace = "kube-system"
+
+	// the port named after the scheme is checked
+	checker.KubenurseServiceURL = "https://kubenurse.kube-system.svc.cluster.local:443"
+
+	endpoints, err := checker.serviceEndpoints(context.Background())
+	r.NoError(err)
+	r.ElementsMatch([]serviceEndpoint{
+		{name: "kubenurse-1", url: "https://10.0.0.1:8443/alwayshappy"},
+		{name: "kubenurse-1_v6", url: "https://[fd00::1]:8443/alwayshappy"},
+	}, endpoints)
+
+	// the port with the number of the service port is checked
+	checker.KubenurseServiceURL = "http://kubenurse.kube-system.svc.cluster.local:9090"
+
+	endpoints, err = checker.serviceEndpoints(context.Background())
+	r.NoError(err)
+	r.ElementsMatch([]serviceEndpoint{
+		{name: "kubenurse-1", url: "http://10.0.0.1:9090/alwayshappy"},
+		{name: "kubenurse-1_v6", url: "http://[fd00::1]:9090/alwayshappy"},
+	}, endpoints)
+
+	// no port can be told apart
+	checker.KubenurseServiceURL = "http://kubenurse.kube-system.svc.cluster.local:80"
+
+	_, err = checker.serviceEndpoints(context.Background())
+	r.Error(err)
+}
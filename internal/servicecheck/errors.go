@@ -0,0 +1,74 @@
+package servicecheck
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// reasons of failed checks, used in the logs and as reason label of kubenurse_errors_total
+const (
+	reasonTimeout           = "timeout"
+	reasonDNS               = "dns"
+	reasonConnectionRefused = "connection_refused"
+	reasonTLS               = "tls"
+	reasonHTTPStatus        = "http_status"
+	reasonBodyMismatch      = "body_mismatch"
+	reasonHTTP2GoAway       = "http2_goaway"
+	reasonHTTP2Stream       = "http2_stream"
+	reasonOther             = "other"
+)
+
+// statusError is returned by doRequest if the status code of the response is not accepted by the check.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return e.status
+}
+
+// classifyError returns the reason of the failure of a check.
+func classifyError(err error) string {
+	var (
+		statusErr    *statusError
+		dnsErr       *net.DNSError
+		netErr       net.Error
+		verifyErr    *tls.CertificateVerificationError
+		recordErr    tls.RecordHeaderError
+		alertErr     tls.AlertError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+
+	switch {
+	case errors.As(err, &statusErr):
+		return reasonHTTPStatus
+	case errors.Is(err, errBodyMismatch):
+		return reasonBodyMismatch
+	// the http2 error types of net/http are not exported, their messages are stable though
+	case strings.Contains(err.Error(), "http2: server sent GOAWAY"),
+		strings.Contains(err.Error(), "http2: Transport received Server's graceful shutdown GOAWAY"):
+		return reasonHTTP2GoAway
+	case strings.Contains(err.Error(), "stream error: stream ID"):
+		return reasonHTTP2Stream
+	// checked before the timeouts, as a dns timeout is a dns failure
+	case errors.As(err, &dnsErr):
+		return reasonDNS
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return reasonTimeout
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return reasonConnectionRefused
+	case errors.As(err, &verifyErr), errors.As(err, &recordErr), errors.As(err, &alertErr),
+		errors.As(err, &authorityErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		return reasonTLS
+	default:
+		return reasonOther
+	}
+}
@@ -0,0 +1,82 @@
+package servicecheck
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyError(t *testing.T) {
+	// errors as returned by the http client, wrapped by doRequest
+	wrap := func(err error) error {
+		return fmt.Errorf("request_id=abc: %w", &url.Error{Op: "Get", URL: "https://kubenurse:8443/alwayshappy", Err: err})
+	}
+
+	var tests = map[string]struct {
+		err  error
+		want string
+	}{
+		"timeout": {
+			err:  wrap(context.DeadlineExceeded),
+			want: reasonTimeout,
+		},
+		"dial timeout": {
+			err:  wrap(&net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}),
+			want: reasonTimeout,
+		},
+		"dns": {
+			err:  wrap(&net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "kubenurse", IsNotFound: true}}),
+			want: reasonDNS,
+		},
+		"dns timeout": {
+			err:  wrap(&net.DNSError{Err: "i/o timeout", Name: "kubenurse", IsTimeout: true}),
+			want: reasonDNS,
+		},
+		"connection refused": {
+			err:  wrap(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}),
+			want: reasonConnectionRefused,
+		},
+		"tls": {
+			err:  wrap(x509.UnknownAuthorityError{}),
+			want: reasonTLS,
+		},
+		"http status": {
+			err:  fmt.Errorf("request_id=abc: %w", &statusError{code: 502, status: "502 Bad Gateway"}),
+			want: reasonHTTPStatus,
+		},
+		"body mismatch": {
+			err:  fmt.Errorf("request_id=abc: %w", errBodyMismatch),
+			want: reasonBodyMismatch,
+		},
+		"http2 goaway": {
+			err:  wrap(errors.New(`http2: server sent GOAWAY and closed the connection; LastStreamID=1, ErrCode=NO_ERROR, debug=""`)),
+			want: reasonHTTP2GoAway,
+		},
+		"http2 graceful goaway": {
+			err:  wrap(errors.New("http2: Transport received Server's graceful shutdown GOAWAY")),
+			want: reasonHTTP2GoAway,
+		},
+		"http2 stream": {
+			err:  wrap(errors.New("stream error: stream ID 3; INTERNAL_ERROR; received from peer")),
+			want: reasonHTTP2Stream,
+		},
+		"other": {
+			err:  errors.New("load kubernetes serviceaccount token"),
+			want: reasonOther,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.want, classifyError(tc.err))
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package servicecheck
+
+// defaultHealthWeights returns the weights of the checks in the health score, unless configured otherwise.
+func defaultHealthWeights() map[string]float64 {
+	return map[string]float64{
+		"api_server_direct": 1,
+		"api_server_dns":    1,
+		"me_ingress":        1,
+		"me_service":        1,
+		"dns_udp":           1,
+		"dns_tcp":           1,
+		"neighbourhood":     2,
+	}
+}
+
+// healthScore summarizes the result in a score between 0 and 100. Every check contributes with its weight in
+// HealthWeights, the neighbourhood with the ratio of reachable neighbours. Skipped checks are not considered.
+func (c *Checker) healthScore(res *Result) float64 {
+	var score, total float64
+
+	add := func(name string, success float64) {
+		w := c.HealthWeights[name]
+		score += w * success
+		total += w
+	}
+
+	addState := func(name, state string) {
+		switch state {
+		case skippedStr, "":
+			// skipped or not performed
+		case okStr:
+			add(name, 1)
+		default:
+			add(name, 0)
+		}
+	}
+
+	if c.DualStackAPIServer {
+		// both address families share the weight of the direct link
+		addState("api_server_direct", res.APIServerDirectV4)
+		addState("api_server_direct", res.APIServerDirectV6)
+	} else {
+		addState("api_server_direct", res.APIServerDirect)
+	}
+
+	// the instances share the weight of the direct link as well
+	for _, state := range res.APIServerEndpoints {
+		addState("api_server_direct", state)
+	}
+
+	addState("api_server_dns", res.APIServerDNS)
+	addState("me_ingress", res.MeIngress)
+	addState("me_service", res.MeService)
+
+	// the endpoints of the service share the weight of me_service, their discovery is not a check of the service
+	for _, state := range res.ServiceEndpoints {
+		addState("me_service", state)
+	}
+
+	addState("dns_udp", res.DNSUDP)
+	addState("dns_tcp", res.DNSTCP)
+
+	// internet_egress has no default weight, its failure may be expected in air-gapped clusters
+	addState("internet_egress", res.InternetEgress)
+
+	// registered checks only contribute if they have a weight
+	for name, state := range res.Checks {
+		addState(name, state)
+	}
+
+	switch {
+	case res.NeighbourhoodState == skippedStr, res.NeighbourhoodState == "":
+	case res.NeighbourhoodState != okStr: // discovery failed
+		add("neighbourhood", 0)
+	case res.checkedNeighbours > 0:
+		add("neighbourhood", float64(res.reachableNeighbours)/float64(res.checkedNeighbours))
+	}
+
+	if total == 0 {
+		return 100
+	}
+
+	return 100 * score / total
+}
+
+// FailedChecks returns the number of failed checks and the number of performed checks of the result. Every
+// checked neighbour counts as a check and a failed neighbour discovery as one failed check, skipped checks are
+// not counted.
+func (res *Result) FailedChecks() (failed, total int) {
+	count := func(state string) {
+		switch state {
+		case skippedStr, "":
+			// skipped or not performed
+		case okStr:
+			total++
+		default:
+			failed++
+			total++
+		}
+	}
+
+	for _, state := range []string{
+		res.APIServerDirect, res.APIServerDirectV4, res.APIServerDirectV6, res.APIServerDNS,
+		res.MeIngress, res.MeService, res.DNSUDP, res.DNSTCP, res.InternetEgress,
+	} {
+		count(state)
+	}
+
+	for _, state := range res.APIServerEndpoints {
+		count(state)
+	}
+
+	count(res.MeServiceEndpoints)
+
+	for _, state := range res.ServiceEndpoints {
+		count(state)
+	}
+
+	for _, state := range res.Checks {
+		count(state)
+	}
+
+	switch res.NeighbourhoodState {
+	case okStr, skippedStr, "":
+	default: // the discovery failed or only got a partial list
+		failed++
+		total++
+	}
+
+	failed += res.checkedNeighbours - res.reachableNeighbours
+	total += res.checkedNeighbours
+
+	return failed, total
+}
@@ -0,0 +1,79 @@
+package servicecheck
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthScore(t *testing.T) {
+	checker := Checker{HealthWeights: defaultHealthWeights()}
+
+	var tests = map[string]struct {
+		res  Result
+		want float64
+	}{
+		"everything skipped": {
+			res:  Result{NeighbourhoodState: skippedStr},
+			want: 100,
+		},
+		"everything ok": {
+			res: Result{
+				APIServerDirect: okStr, APIServerDNS: okStr, MeIngress: okStr, MeService: okStr,
+				DNSUDP: skippedStr, DNSTCP: skippedStr,
+				NeighbourhoodState: okStr, reachableNeighbours: 10, checkedNeighbours: 10,
+			},
+			want: 100,
+		},
+		"ingress down, half of the neighbours unreachable": {
+			res: Result{
+				APIServerDirect: okStr, APIServerDNS: okStr, MeIngress: "502 Bad Gateway", MeService: okStr,
+				DNSUDP: skippedStr, DNSTCP: skippedStr,
+				NeighbourhoodState: okStr, reachableNeighbours: 5, checkedNeighbours: 10,
+			},
+			want: 100 * (3 + 2*0.5) / 6,
+		},
+		"service endpoint down, the discovery does not count": {
+			res: Result{
+				MeServiceEndpoints: okStr, ServiceEndpoints: map[string]string{"me_service_endpoint_kubenurse-1": errStr},
+				NeighbourhoodState: skippedStr,
+			},
+			want: 0,
+		},
+		"neighbourhood discovery failed": {
+			res: Result{
+				APIServerDirect: okStr, APIServerDNS: okStr, MeIngress: skippedStr, MeService: skippedStr,
+				DNSUDP: skippedStr, DNSTCP: skippedStr,
+				NeighbourhoodState: "list pods: forbidden",
+			},
+			want: 50,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.InDelta(t, tc.want, checker.healthScore(&tc.res), 0.001)
+		})
+	}
+}
+
+func TestFailedChecks(t *testing.T) {
+	r := require.New(t)
+
+	res := Result{
+		APIServerDirect: okStr, APIServerDNS: okStr, MeIngress: "502 Bad Gateway", MeService: okStr,
+		DNSUDP: skippedStr, DNSTCP: skippedStr,
+		NeighbourhoodState: okStr, reachableNeighbours: 8, checkedNeighbours: 10,
+	}
+
+	failed, total := res.FailedChecks()
+	r.Equal(3, failed)
+	r.Equal(14, total)
+
+	res.NeighbourhoodState = "list pods: forbidden"
+	res.reachableNeighbours, res.checkedNeighbours = 0, 0
+
+	failed, total = res.FailedChecks()
+	r.Equal(2, failed)
+	r.Equal(5, total)
+}
@@ -23,15 +23,17 @@ func (rt RoundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
 }
 
 // This collects traces and logs errors. As promhttp.InstrumentRoundTripperTrace doesn't process
-// errors, this is custom made and inspired by prometheus/client_golang's promhttp
-func withHttptrace(registry *prometheus.Registry, next http.RoundTripper, durationHistogram []float64) http.RoundTripper {
+// errors, this is custom made and inspired by prometheus/client_golang's promhttp. The check is
+// exposed with the label checkLabel.
+func withHttptrace(registry *prometheus.Registry, next http.RoundTripper, durationHistogram []float64,
+	checkLabel string) http.RoundTripper {
 	httpclientReqTotal := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: metricsNamespace,
 			Name:      "httpclient_requests_total",
 			Help:      "A counter for requests from the kubenurse http client.",
 		},
-		[]string{"code", "method", "type"},
+		[]string{"code", "method", checkLabel},
 	)
 
 	httpclientReqDuration := prometheus.NewHistogramVec(
@@ -41,7 +43,7 @@ func withHttptrace(registry *prometheus.Registry, next http.RoundTripper, durati
 			Help:      "A latency histogram of request latencies from the kubenurse http client.",
 			Buckets:   durationHistogram,
 		},
-		[]string{"type"},
+		[]string{checkLabel},
 	)
 
 	httpclientTraceReqDuration := prometheus.NewHistogramVec(
@@ -51,10 +53,37 @@ func withHttptrace(registry *prometheus.Registry, next http.RoundTripper, durati
 			Help:      "Latency histogram for requests from the kubenurse http client. Time in seconds since the start of the http request.",
 			Buckets:   durationHistogram,
 		},
-		[]string{"event", "type"},
+		[]string{"event", checkLabel},
 	)
 
-	registry.MustRegister(httpclientReqTotal, httpclientReqDuration, httpclientTraceReqDuration)
+	tlsCertExpiry := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "tls_cert_expiry_seconds",
+			Help:      "Seconds until the leaf certificate presented by the checked https endpoint expires.",
+		},
+		[]string{checkLabel},
+	)
+
+	connReused := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "connection_reused_total",
+			Help:      "A counter for requests from the kubenurse http client which reused an idle connection.",
+		},
+		[]string{checkLabel},
+	)
+
+	connNew := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "connection_new_total",
+			Help:      "A counter for requests from the kubenurse http client which dialed a new connection.",
+		},
+		[]string{checkLabel},
+	)
+
+	registry.MustRegister(httpclientReqTotal, httpclientReqDuration, httpclientTraceReqDuration, tlsCertExpiry, connReused, connNew)
 
 	collectMetric := func(traceEventType string, start time.Time, r *http.Request, err error) {
 		td := time.Since(start).Seconds()
@@ -76,8 +105,15 @@ func withHttptrace(registry *prometheus.Registry, next http.RoundTripper, durati
 
 		// Add tracing hooks
 		trace := &httptrace.ClientTrace{
-			GotConn: func(_ httptrace.GotConnInfo) {
+			GotConn: func(info httptrace.GotConnInfo) {
 				collectMetric("got_conn", start, r, nil)
+
+				kubenurseTypeLabel := r.Context().Value(kubenurseTypeKey{}).(string)
+				if info.Reused {
+					connReused.WithLabelValues(kubenurseTypeLabel).Inc()
+				} else {
+					connNew.WithLabelValues(kubenurseTypeLabel).Inc()
+				}
 			},
 			DNSStart: func(_ httptrace.DNSStartInfo) {
 				collectMetric("dns_start", start, r, nil)
@@ -108,14 +144,22 @@ func withHttptrace(registry *prometheus.Registry, next http.RoundTripper, durati
 		// Do request with tracing enabled
 		r = r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
 
-		typeFromCtxFn := promhttp.WithLabelFromCtx("type", func(ctx context.Context) string {
+		checkFromCtxFn := promhttp.WithLabelFromCtx(checkLabel, func(ctx context.Context) string {
 			return ctx.Value(kubenurseTypeKey{}).(string)
 		})
 
 		rt := next // variable pinning :) essential, to prevent always re-instrumenting the original variable
-		rt = promhttp.InstrumentRoundTripperCounter(httpclientReqTotal, rt, typeFromCtxFn)
-		rt = promhttp.InstrumentRoundTripperDuration(httpclientReqDuration, rt, typeFromCtxFn)
+		rt = promhttp.InstrumentRoundTripperCounter(httpclientReqTotal, rt, checkFromCtxFn)
+		rt = promhttp.InstrumentRoundTripperDuration(httpclientReqDuration, rt, checkFromCtxFn)
+
+		resp, err := rt.RoundTrip(r)
+
+		// the connection state is also available for reused connections, contrary to the TLSHandshakeDone hook
+		if err == nil && resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+			kubenurseTypeLabel := r.Context().Value(kubenurseTypeKey{}).(string)
+			tlsCertExpiry.WithLabelValues(kubenurseTypeLabel).Set(time.Until(resp.TLS.PeerCertificates[0].NotAfter).Seconds())
+		}
 
-		return rt.RoundTrip(r)
+		return resp, err
 	})
 }
@@ -0,0 +1,54 @@
+package servicecheck
+
+import (
+	"maps"
+	"sync"
+)
+
+// ewmaAlpha is the smoothing factor of the latency average, higher values discount older latencies faster
+const ewmaAlpha = 0.3
+
+// latencyTracker keeps an exponentially weighted moving average of the duration of every check.
+type latencyTracker struct {
+	mu      sync.Mutex
+	average map[string]float64
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{
+		average: make(map[string]float64),
+	}
+}
+
+// observe updates the average of the check with a duration in seconds and returns the new average.
+func (t *latencyTracker) observe(label string, seconds float64) float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	avg, ok := t.average[label]
+	if !ok {
+		avg = seconds
+	} else {
+		avg = ewmaAlpha*seconds + (1-ewmaAlpha)*avg
+	}
+
+	t.average[label] = avg
+
+	return avg
+}
+
+// forget discards the average of a check.
+func (t *latencyTracker) forget(label string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.average, label)
+}
+
+// snapshot returns a copy of the averages of all checks.
+func (t *latencyTracker) snapshot() map[string]float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return maps.Clone(t.average)
+}
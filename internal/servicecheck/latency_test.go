@@ -0,0 +1,59 @@
+package servicecheck
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestLatencyTracker(t *testing.T) {
+	r := require.New(t)
+
+	l := newLatencyTracker()
+
+	// the first sample is the average
+	r.InDelta(1.0, l.observe("me_service", 1), 0.001)
+
+	// 0.3*2 + 0.7*1
+	r.InDelta(1.3, l.observe("me_service", 2), 0.001)
+
+	// 0.3*0 + 0.7*1.3
+	r.InDelta(0.91, l.observe("me_service", 0), 0.001)
+
+	// labels are tracked independently
+	r.InDelta(0.5, l.observe("me_ingress", 0.5), 0.001)
+
+	// a forgotten label starts over
+	l.forget("me_service")
+	r.InDelta(3.0, l.observe("me_service", 3), 0.001)
+	r.Equal(map[string]float64{"me_service": 3, "me_ingress": 0.5}, l.snapshot())
+}
+
+func TestLatencyGauge(t *testing.T) {
+	r := require.New(t)
+
+	registry := prometheus.NewRegistry()
+
+	checker, err := New(context.Background(), fake.NewFakeClient(), registry, false, 0, prometheus.DefBuckets)
+	r.NoError(err)
+
+	check := func(_ context.Context) (string, error) { return okStr, nil }
+
+	for range 3 {
+		_, err = checker.measure(context.Background(), check, "custom")
+		r.NoError(err)
+	}
+
+	// the gauge is the average of the tracker
+	r.Equal(checker.latencies.snapshot(), gaugeValues(t, registry, "kubenurse_check_latency_ewma_seconds", "custom"))
+
+	// skipped checks are not measured
+	_, err = checker.measure(context.Background(), func(_ context.Context) (string, error) {
+		return skippedStr, nil
+	}, "skipped")
+	r.NoError(err)
+	r.Empty(gaugeValues(t, registry, "kubenurse_check_latency_ewma_seconds", "skipped"))
+}
@@ -5,8 +5,13 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"math"
+	"net"
 	"os"
+	"sync"
+	"time"
 
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/labels"
@@ -27,37 +32,54 @@ type Neighbour struct {
 	HostIP   string
 	NodeName string
 	NodeHash uint64
+	// DNSName is the stable DNS name of the pod, only set if the pod has a hostname and subdomain
+	DNSName string
 }
 
-// GetNeighbours returns a slice of neighbour kubenurses for the given namespace and labelSelector.
+// defaultNeighbourTimeout is the timeout of a neighbour check, neighbours should answer much faster than other checks
+const defaultNeighbourTimeout = 2 * time.Second
+
+// neighbourListRetries is the number of times a failed page of the pod list is retried
+const neighbourListRetries = 2
+
+// neighbourListBackoff is the delay before the first retry of a failed page, it is doubled for every further retry
+const neighbourListBackoff = 100 * time.Millisecond
+
+// errPartialNeighbourList is returned by GetNeighbours together with the neighbours of the pages fetched
+// so far, if a page of the pod list could not be fetched.
+var errPartialNeighbourList = errors.New("partial neighbour list")
+
+// NeighbourResult is the outcome of the check of a single neighbour
+type NeighbourResult struct {
+	NodeName  string  `json:"node_name"`
+	PodName   string  `json:"pod_name"`
+	State     string  `json:"state"` // ok, error or skipped
+	Reachable bool    `json:"reachable"`
+	Latency   float64 `json:"latency_seconds"`
+	Version   string  `json:"version,omitempty"` // announced by the neighbour, empty for versions without the header
+	Error     string  `json:"error,omitempty"`
+}
+
+// GetNeighbours returns a slice of neighbour kubenurses for the given namespace and labelSelector. If a page of a
+// paginated pod list cannot be fetched, the neighbours found so far are returned with errPartialNeighbourList.
 func (c *Checker) GetNeighbours(ctx context.Context, namespace, labelSelector string) ([]*Neighbour, error) {
 	// Get all pods
-	pods := v1.PodList{}
-	selector, _ := labels.Parse(labelSelector)
-	err := c.client.List(ctx, &pods, &client.ListOptions{
-		LabelSelector: selector,
-		Namespace:     namespace,
-	})
-
-	if err != nil {
-		return nil, fmt.Errorf("list pods: %w", err)
+	pods, err := c.listPods(ctx, namespace, labelSelector)
+	if err != nil && !errors.Is(err, errPartialNeighbourList) {
+		return nil, err
 	}
 
-	var neighbours = make([]*Neighbour, 0, len(pods.Items))
+	var neighbours = make([]*Neighbour, 0, len(pods))
 
 	var hostname, _ = osHostname()
 
 	// process pods
-	for idx := range pods.Items {
-		pod := pods.Items[idx]
-
-		if !c.allowUnschedulable { // if we disallow unschedulable nodes, we have to check their status
-			n := v1.Node{}
-			if err := c.client.Get(ctx, types.NamespacedName{Name: pod.Spec.NodeName}, &n); err == nil {
-				if n.Spec.Unschedulable { // node unschedulable, we do not include this pod in the neighbour list
-					continue
-				}
-			}
+	for idx := range pods {
+		pod := pods[idx]
+
+		// if we disallow unschedulable nodes, we do not include pods on such nodes in the neighbour list
+		if !c.allowUnschedulable && c.nodeUnschedulable(ctx, pod.Spec.NodeName) {
+			continue
 		}
 
 		if pod.Status.Phase != v1.PodRunning || // only query running pods (excludes pending ones)
@@ -67,7 +89,10 @@ func (c *Checker) GetNeighbours(ctx context.Context, namespace, labelSelector st
 
 		if pod.Name == hostname { // only query other pods, not the currently running pod
 			currentNode = pod.Spec.NodeName
-			continue
+
+			if !c.NeighbourIncludeSelf {
+				continue
+			}
 		}
 
 		n := Neighbour{
@@ -77,36 +102,304 @@ func (c *Checker) GetNeighbours(ctx context.Context, namespace, labelSelector st
 			NodeName: pod.Spec.NodeName,
 			NodeHash: sha256Uint64(pod.Spec.NodeName),
 		}
+
+		if pod.Spec.Hostname != "" && pod.Spec.Subdomain != "" {
+			n.DNSName = fmt.Sprintf("%s.%s.%s.svc.cluster.local", pod.Spec.Hostname, pod.Spec.Subdomain, pod.Namespace)
+		}
 		neighbours = append(neighbours, &n)
 	}
 
-	return neighbours, nil
+	// the current node is only known once the own pod was found, other pods on it are removed afterwards
+	return c.excludeSelf(neighbours), err
 }
 
-// checkNeighbours checks the /alwayshappy endpoint from every discovered kubenurse neighbour. Neighbour pods on nodes
-// which are not schedulable are excluded from this check to avoid possible false errors.
-func (c *Checker) checkNeighbours(nh []*Neighbour) {
-	if c.NeighbourLimit > 0 && len(nh) > c.NeighbourLimit {
+// excludeSelf removes the neighbours on the current node, unless NeighbourIncludeSelf is set.
+func (c *Checker) excludeSelf(nh []*Neighbour) []*Neighbour {
+	if c.NeighbourIncludeSelf || currentNode == "" {
+		return nh
+	}
+
+	// nh is not modified, it may be the discovered neighbourhood of the result
+	others := make([]*Neighbour, 0, len(nh))
+
+	for _, n := range nh {
+		if n.NodeName != currentNode {
+			others = append(others, n)
+		}
+	}
+
+	return others
+}
+
+// listPods lists the pods in pages of NeighbourPageSize, if set. A failed page is retried with a backoff, if it
+// still fails after the first page, the pods listed so far are returned with errPartialNeighbourList.
+func (c *Checker) listPods(ctx context.Context, namespace, labelSelector string) ([]v1.Pod, error) {
+	selector, _ := labels.Parse(labelSelector)
+	opts := &client.ListOptions{
+		LabelSelector: selector,
+		Namespace:     namespace,
+		Limit:         c.NeighbourPageSize,
+	}
+
+	var items []v1.Pod
+
+	for {
+		pods := v1.PodList{}
+
+		err := c.listPage(ctx, &pods, opts)
+
+		switch {
+		case err != nil && opts.Continue == "":
+			c.neighbourListPartial.Set(0)
+			return nil, fmt.Errorf("list pods: %w", err)
+		case err != nil:
+			c.neighbourListPartial.Set(1)
+			return items, fmt.Errorf("%w, %d pods listed: %w", errPartialNeighbourList, len(items), err)
+		}
+
+		// readers which do not paginate, like the watch cache, truncate the list to the limit without a continue
+		// token. A full first page without one is listed again without limit, to not miss any neighbour.
+		if opts.Limit > 0 && opts.Continue == "" && pods.Continue == "" && int64(len(pods.Items)) >= opts.Limit {
+			opts.Limit = 0
+
+			if err := c.listPage(ctx, &pods, opts); err != nil {
+				c.neighbourListPartial.Set(0)
+				return nil, fmt.Errorf("list pods: %w", err)
+			}
+		}
+
+		items = append(items, pods.Items...)
+
+		if pods.Continue == "" {
+			c.neighbourListPartial.Set(0)
+			return items, nil
+		}
+
+		opts.Continue = pods.Continue
+	}
+}
+
+// listPage lists a page of pods, a failed request is retried up to neighbourListRetries times with a backoff.
+func (c *Checker) listPage(ctx context.Context, pods *v1.PodList, opts *client.ListOptions) error {
+	backoff := neighbourListBackoff
+
+	for attempt := 0; ; attempt++ {
+		err := c.client.List(ctx, pods, opts)
+		if err == nil || attempt == neighbourListRetries {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// nodeUnschedulable returns true if the given node is cordoned. Errors while getting the node are ignored.
+func (c *Checker) nodeUnschedulable(ctx context.Context, nodeName string) bool {
+	n := v1.Node{}
+	if err := c.client.Get(ctx, types.NamespacedName{Name: nodeName}, &n); err != nil {
+		return false
+	}
+
+	return n.Spec.Unschedulable
+}
+
+// checkNeighbours checks the /alwayshappy endpoint from every discovered kubenurse neighbour, up to
+// NeighbourConcurrency at a time. Neighbour pods on nodes which are not schedulable are excluded from this check
+// to avoid possible false errors. As nodes can be cordoned after the discovery, their state is checked again right
+// before the request. The outcome of every neighbour check is returned, together with the number of reachable
+// neighbours and of checked (not skipped) neighbours.
+func (c *Checker) checkNeighbours(ctx context.Context, nh []*Neighbour) (results []NeighbourResult, reachable, checked int) {
+	if limit := c.neighbourLimit(len(nh)); limit > 0 && len(nh) > limit {
 		nh = c.filterNeighbours(nh)
 	}
 
-	for _, neighbour := range nh {
+	c.setSelectedNeighbours(nh)
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex // protects reachable and checked
+		sem = make(chan struct{}, max(c.NeighbourConcurrency, 1))
+	)
+
+	// every check sets its own element, in the order of the neighbours
+	results = make([]NeighbourResult, len(nh))
+
+	for i, neighbour := range nh {
+		var version string // announced by the neighbour
+
 		check := func(ctx context.Context) (string, error) {
-			if c.UseTLS {
-				return c.doRequest(ctx, "https://"+neighbour.PodIP+":8443/alwayshappy")
+			if !c.allowUnschedulable && c.nodeUnschedulable(ctx, neighbour.NodeName) {
+				c.neighboursSkipped.Inc()
+				return skippedStr, nil
+			}
+
+			// the neighbour timeout is independent of the timeout of the http client, to detect slow neighbours early
+			if c.NeighbourTimeout > 0 {
+				var cancel context.CancelFunc
+
+				ctx, cancel = context.WithTimeout(ctx, c.NeighbourTimeout)
+				defer cancel()
+			}
+
+			res, v, err := c.doRequestVersion(ctx, c.neighbourURL(neighbour))
+			version = v
+
+			return res, err
+		}
+
+		sem <- struct{}{}
+
+		wg.Add(1)
+
+		go func() {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			start := time.Now()
+			res, err := c.measure(ctx, check, "path_"+neighbour.NodeName)
+			state := checkState(res, err)
+
+			results[i] = NeighbourResult{
+				NodeName:  neighbour.NodeName,
+				PodName:   neighbour.PodName,
+				State:     state,
+				Reachable: state == okStr,
+				Latency:   time.Since(start).Seconds(),
+				Version:   version,
 			}
 
-			return c.doRequest(ctx, "http://"+neighbour.PodIP+":8080/alwayshappy")
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			switch state {
+			case okStr:
+				reachable++
+				checked++
+			case errStr:
+				checked++
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	c.neighbourVersionSkew.Set(float64(c.versionSkew(results)))
+	c.neighbourhoodReachable.Set(float64(reachable))
+	c.neighbourhoodTotal.Set(float64(checked))
+
+	return results, reachable, checked
+}
+
+// versionSkew returns the number of reachable neighbours running another version than this kubenurse. Neighbours
+// not announcing their version run an older one. It is 0 if the version of this kubenurse is unknown.
+func (c *Checker) versionSkew(results []NeighbourResult) int {
+	if c.Version == "" {
+		return 0
+	}
+
+	var skew int
+
+	for _, r := range results {
+		if r.Reachable && r.Version != c.Version {
+			skew++
+		}
+	}
+
+	return skew
+}
+
+// neighbourURL returns the url of the /alwayshappy endpoint of the given neighbour. The pod DNS name is used
+// instead of the pod IP if NeighbourUseDNS is set and the neighbour has one.
+func (c *Checker) neighbourURL(n *Neighbour) string {
+	scheme, port, host := c.NeighbourScheme, c.NeighbourPort, n.PodIP
+
+	if c.NeighbourUseDNS && n.DNSName != "" {
+		host = n.DNSName
+	}
+
+	if scheme == "" {
+		scheme = "http"
+		if c.UseTLS {
+			scheme = "https"
 		}
+	}
 
-		_, _ = c.measure(check, "path_"+neighbour.NodeName)
+	if port == "" {
+		port = "8080"
+		if c.UseTLS {
+			port = "8443"
+		}
 	}
+
+	return scheme + "://" + net.JoinHostPort(host, port) + c.SelfCheckPath
+}
+
+// SelectedNeighbours returns the neighbours checked during the last run, after filtering.
+func (c *Checker) SelectedNeighbours() []*Neighbour {
+	c.selectedMu.Lock()
+	defer c.selectedMu.Unlock()
+
+	return c.selectedNeighbours
+}
+
+func (c *Checker) setSelectedNeighbours(nh []*Neighbour) {
+	c.selectedMu.Lock()
+	defer c.selectedMu.Unlock()
+
+	c.selectedNeighbours = nh
+
+	if c.ExposeSelectedNeighbours {
+		c.selectedNeighbourGauge.Reset()
+
+		for _, n := range nh {
+			c.selectedNeighbourGauge.WithLabelValues(n.NodeName).Set(1)
+		}
+	}
+}
+
+// neighbourLimit returns the maximum number of neighbours to check out of the discovered ones, 0 means no limit.
+// If NeighbourFraction is set, it is computed as a fraction of the discovered neighbours clamped to
+// NeighbourFractionMin and NeighbourFractionMax, otherwise NeighbourLimit is returned.
+func (c *Checker) neighbourLimit(discovered int) int {
+	if c.NeighbourCheckAll {
+		return 0
+	}
+
+	if c.NeighbourFraction <= 0 {
+		return c.NeighbourLimit
+	}
+
+	limit := int(math.Ceil(c.NeighbourFraction * float64(discovered)))
+	limit = max(limit, c.NeighbourFractionMin)
+
+	if c.NeighbourFractionMax > 0 {
+		limit = min(limit, c.NeighbourFractionMax)
+	}
+
+	return limit
 }
 
+// filterNeighbours selects the neighbours to check out of the discovered ones, excluding the current node unless
+// NeighbourIncludeSelf is set. The nodes are ordered by their hash relative to the hash of the current node, so that
+// every node is checked by the same number of neighbours.
 func (c *Checker) filterNeighbours(nh []*Neighbour) []*Neighbour {
-	m := make(map[uint64]*Neighbour, c.NeighbourLimit+1)
+	// the current node does not take a slot
+	nh = c.excludeSelf(nh)
+	limit := c.neighbourLimit(len(nh))
+	m := make(map[uint64]*Neighbour, limit+1)
 
-	sl := make(Uint64Heap, 0, c.NeighbourLimit+1)
+	sl := make(Uint64Heap, 0, limit+1)
 	h := &sl
 	currentNodeHash := sha256Uint64(currentNode)
 
@@ -118,13 +411,13 @@ func (c *Checker) filterNeighbours(nh []*Neighbour) []*Neighbour {
 
 		heap.Push(h, adjHash)
 
-		if len(*h) > c.NeighbourLimit {
+		if len(*h) > limit {
 			p := heap.Pop(h).(uint64)
 			delete(m, p)
 		}
 	}
 
-	filteredNeighbours := make([]*Neighbour, 0, c.NeighbourLimit)
+	filteredNeighbours := make([]*Neighbour, 0, limit)
 
 	for _, n := range m {
 		filteredNeighbours = append(filteredNeighbours, n)
@@ -1,10 +1,21 @@
 package servicecheck
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
 )
 
 func generateNeighbours(n int) (nh []*Neighbour) {
@@ -72,3 +83,268 @@ func TestNodeFiltering(t *testing.T) {
 
 	})
 }
+
+func TestNodeFilteringExcludesSelf(t *testing.T) {
+	r := require.New(t)
+
+	nh := generateNeighbours(100)
+	currentNode = nh[0].NodeName
+
+	defer func() { currentNode = "" }()
+
+	checker := Checker{NeighbourLimit: 10}
+
+	filtered := checker.filterNeighbours(nh)
+	r.Len(filtered, 10)
+	r.NotContains(filtered, nh[0])
+
+	// the discovered neighbours are not modified
+	r.Len(nh, 100)
+	r.Equal(currentNode, nh[0].NodeName)
+
+	checker.NeighbourIncludeSelf = true
+	r.Contains(checker.filterNeighbours(nh), nh[0])
+}
+
+func TestNeighbourLimit(t *testing.T) {
+	var tests = map[string]struct {
+		checker    Checker
+		discovered int
+		want       int
+	}{
+		"flat limit": {
+			checker:    Checker{NeighbourLimit: 10},
+			discovered: 1_000,
+			want:       10,
+		},
+		"fraction": {
+			checker:    Checker{NeighbourLimit: 10, NeighbourFraction: 0.05},
+			discovered: 1_000,
+			want:       50,
+		},
+		"fraction rounds up": {
+			checker:    Checker{NeighbourFraction: 0.05},
+			discovered: 30,
+			want:       2,
+		},
+		"fraction min clamp": {
+			checker:    Checker{NeighbourFraction: 0.05, NeighbourFractionMin: 5},
+			discovered: 30,
+			want:       5,
+		},
+		"fraction max clamp": {
+			checker:    Checker{NeighbourFraction: 0.05, NeighbourFractionMax: 20},
+			discovered: 1_000,
+			want:       20,
+		},
+		"check all": {
+			checker:    Checker{NeighbourLimit: 10, NeighbourFraction: 0.05, NeighbourCheckAll: true},
+			discovered: 1_000,
+			want:       0,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.want, tc.checker.neighbourLimit(tc.discovered))
+		})
+	}
+}
+
+func TestNeighbourURL(t *testing.T) {
+	n := &Neighbour{PodIP: "10.0.0.1", DNSName: "kubenurse-abcd.kubenurse.kube-system.svc.cluster.local"}
+
+	var tests = map[string]struct {
+		checker Checker
+		want    string
+	}{
+		"default": {
+			checker: Checker{SelfCheckPath: "/alwayshappy"},
+			want:    "http://10.0.0.1:8080/alwayshappy",
+		},
+		"tls": {
+			checker: Checker{SelfCheckPath: "/alwayshappy", UseTLS: true},
+			want:    "https://10.0.0.1:8443/alwayshappy",
+		},
+		"custom": {
+			checker: Checker{SelfCheckPath: "/nurse/alwayshappy", NeighbourScheme: "https", NeighbourPort: "9443"},
+			want:    "https://10.0.0.1:9443/nurse/alwayshappy",
+		},
+		"dns": {
+			checker: Checker{SelfCheckPath: "/alwayshappy", NeighbourUseDNS: true},
+			want:    "http://kubenurse-abcd.kubenurse.kube-system.svc.cluster.local:8080/alwayshappy",
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			require.Equal(t, tc.want, tc.checker.neighbourURL(n))
+		})
+	}
+
+	t.Run("dns fallback to ip", func(t *testing.T) {
+		checker := Checker{SelfCheckPath: "/alwayshappy", NeighbourUseDNS: true}
+		require.Equal(t, "http://10.0.0.1:8080/alwayshappy", checker.neighbourURL(&Neighbour{PodIP: "10.0.0.1"}))
+	})
+}
+
+func TestPartialNeighbourList(t *testing.T) {
+	r := require.New(t)
+
+	var calls int
+
+	// the first page succeeds, every following request fails
+	fakeClient := fake.NewClientBuilder().WithInterceptorFuncs(interceptor.Funcs{
+		List: func(_ context.Context, _ client.WithWatch, list client.ObjectList, _ ...client.ListOption) error {
+			calls++
+			if calls > 1 {
+				return errors.New("page unavailable")
+			}
+
+			pods := list.(*v1.PodList)
+			pods.Items = []v1.Pod{fakeNeighbourPod}
+			pods.Continue = "next"
+
+			return nil
+		},
+	}).Build()
+
+	checker, err := New(context.Background(), fakeClient, prometheus.NewRegistry(), true, 0, prometheus.DefBuckets)
+	r.NoError(err)
+
+	checker.NeighbourPageSize = 1
+
+	nh, err := checker.GetNeighbours(context.Background(), "kube-system", "app=kubenurse")
+	r.ErrorIs(err, errPartialNeighbourList)
+	r.Len(nh, 1)
+	r.Equal(2+neighbourListRetries, calls)
+}
+
+func TestUnpaginatedNeighbourList(t *testing.T) {
+	r := require.New(t)
+
+	pods := make([]client.Object, 0, 3)
+
+	for i := range 3 {
+		pod := fakeNeighbourPod.DeepCopy()
+		pod.Name = fmt.Sprintf("kubenurse-%d", i)
+		pod.Spec.NodeName = fmt.Sprintf("node-%d", i)
+		pod.Status.Phase = v1.PodRunning
+		pods = append(pods, pod)
+	}
+
+	// like the watch cache, the reader truncates the list to the limit without a continue token
+	fakeClient := fake.NewClientBuilder().WithObjects(pods...).WithInterceptorFuncs(interceptor.Funcs{
+		List: func(ctx context.Context, c client.WithWatch, list client.ObjectList, opts ...client.ListOption) error {
+			o := client.ListOptions{}
+			o.ApplyOptions(opts)
+
+			if err := c.List(ctx, list, opts...); err != nil {
+				return err
+			}
+
+			pods := list.(*v1.PodList)
+			if o.Limit > 0 && int64(len(pods.Items)) > o.Limit {
+				pods.Items = pods.Items[:o.Limit]
+			}
+
+			pods.Continue = ""
+
+			return nil
+		},
+	}).Build()
+
+	checker, err := New(context.Background(), fakeClient, prometheus.NewRegistry(), true, 0, prometheus.DefBuckets)
+	r.NoError(err)
+
+	checker.NeighbourPageSize = 2
+	checker.neighbourListPartial.Set(1)
+
+	nh, err := checker.GetNeighbours(context.Background(), "kube-system", "app=kubenurse")
+	r.NoError(err)
+	r.Len(nh, 3)
+	r.InDelta(0.0, testutil.ToFloat64(checker.neighbourListPartial), 0.001)
+}
+
+func TestFailedNeighbourList(t *testing.T) {
+	r := require.New(t)
+
+	var calls int
+
+	fakeClient := fake.NewClientBuilder().WithInterceptorFuncs(interceptor.Funcs{
+		List: func(_ context.Context, _ client.WithWatch, _ client.ObjectList, _ ...client.ListOption) error {
+			calls++
+			return errors.New("unavailable")
+		},
+	}).Build()
+
+	checker, err := New(context.Background(), fakeClient, prometheus.NewRegistry(), true, 0, prometheus.DefBuckets)
+	r.NoError(err)
+
+	// the value of a previous partial list is reset
+	checker.neighbourListPartial.Set(1)
+
+	_, err = checker.GetNeighbours(context.Background(), "kube-system", "app=kubenurse")
+	r.Error(err)
+	r.NotErrorIs(err, errPartialNeighbourList)
+	r.Equal(1+neighbourListRetries, calls)
+	r.InDelta(0.0, testutil.ToFloat64(checker.neighbourListPartial), 0.001)
+}
+
+func TestNeighbourCordonedAfterDiscovery(t *testing.T) {
+	r := require.New(t)
+
+	objects := make([]client.Object, 0, 4)
+
+	for _, node := range []string{"node-a", "node-b"} {
+		pod := fakeNeighbourPod.DeepCopy()
+		pod.Name = "kubenurse-" + node
+		pod.Spec.NodeName = node
+		objects = append(objects, pod, &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: node}})
+	}
+
+	fakeClient := fake.NewClientBuilder().WithObjects(objects...).Build()
+
+	checker, err := New(context.Background(), fakeClient, prometheus.NewRegistry(), false, 0, prometheus.DefBuckets)
+	r.NoError(err)
+
+	checker.NeighbourTimeout = time.Second
+
+	nh, err := checker.GetNeighbours(context.Background(), "kube-system", "app=kubenurse")
+	r.NoError(err)
+	r.Len(nh, 2)
+
+	// node-b is cordoned between the discovery and the check
+	node := v1.Node{}
+	r.NoError(fakeClient.Get(context.Background(), types.NamespacedName{Name: "node-b"}, &node))
+	node.Spec.Unschedulable = true
+	r.NoError(fakeClient.Update(context.Background(), &node))
+
+	results, reachable, checked := checker.checkNeighbours(context.Background(), nh)
+	r.Len(results, 2)
+	r.Zero(reachable)
+	r.Equal(1, checked)
+
+	states := make(map[string]string)
+	for _, res := range results {
+		states[res.NodeName] = res.State
+	}
+
+	r.Equal(map[string]string{"node-a": errStr, "node-b": skippedStr}, states)
+	r.InDelta(1.0, testutil.ToFloat64(checker.neighboursSkipped), 0.001)
+	r.InDelta(1.0, testutil.ToFloat64(checker.neighbourhoodTotal), 0.001)
+}
+
+func TestVersionSkew(t *testing.T) {
+	r := require.New(t)
+
+	results := []NeighbourResult{
+		{NodeName: "a", Reachable: true, Version: "v1.14.0"},
+		{NodeName: "b", Reachable: true, Version: "v1.13.0"},
+		{NodeName: "c", Reachable: true}, // older version without the header
+		{NodeName: "d", Reachable: false},
+	}
+
+	r.Equal(2, (&Checker{Version: "v1.14.0"}).versionSkew(results))
+	r.Equal(0, (&Checker{}).versionSkew(results))
+}
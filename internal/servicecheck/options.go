@@ -0,0 +1,101 @@
+package servicecheck
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Option configures a Checker created with New, for users of this package which do not configure it with
+// environment variables. The environment variables parsed by the kubenurse server are applied on top.
+type Option func(*options)
+
+// options are collected from the Option values before the Checker is built.
+type options struct {
+	neighbourConcurrency int
+	runTimeout           time.Duration
+	settings             *Settings
+}
+
+// WithNeighbourConcurrency sets the number of neighbours checked concurrently, the neighbours are checked one
+// after the other by default. The other checks are always run one after the other.
+func WithNeighbourConcurrency(n int) Option {
+	return func(o *options) {
+		o.neighbourConcurrency = n
+	}
+}
+
+// WithRunTimeout bounds the duration of a whole Run, checks still in flight are cancelled when it is reached.
+func WithRunTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.runTimeout = d
+	}
+}
+
+// Settings configure the metric labels and the http transport of a Checker, they cannot be changed once it is
+// created. New reads them from the environment with SettingsFromEnv, unless they are given with WithSettings.
+type Settings struct {
+	CheckLabel       string // name of the label carrying the check, see KUBENURSE_CHECK_LABEL
+	PodLabels        bool   // add the pod and namespace labels, see KUBENURSE_POD_LABELS
+	ExtraCA          string
+	Insecure         bool
+	TLSMinVersion    string
+	TLSMaxVersion    string
+	TLSCiphers       []string
+	DialTimeout      time.Duration
+	DialKeepAlive    time.Duration
+	SourceIP         string
+	SOCKSProxy       string
+	ReuseConnections bool
+}
+
+// DefaultSettings returns the settings used if nothing is configured.
+func DefaultSettings() Settings {
+	return Settings{
+		DialTimeout:   30 * time.Second,
+		DialKeepAlive: 30 * time.Second,
+	}
+}
+
+// SettingsFromEnv returns the default settings, overridden by the KUBENURSE_* environment variables.
+func SettingsFromEnv() (Settings, error) {
+	s := DefaultSettings()
+
+	s.CheckLabel = os.Getenv("KUBENURSE_CHECK_LABEL")
+	s.PodLabels = os.Getenv("KUBENURSE_POD_LABELS") == "true"
+	s.ExtraCA = os.Getenv("KUBENURSE_EXTRA_CA")
+	s.Insecure = os.Getenv("KUBENURSE_INSECURE") == "true"
+	s.TLSMinVersion = os.Getenv("KUBENURSE_TLS_MIN_VERSION")
+	s.TLSMaxVersion = os.Getenv("KUBENURSE_TLS_MAX_VERSION")
+	s.SourceIP = os.Getenv("KUBENURSE_SOURCE_IP")
+	s.SOCKSProxy = os.Getenv("KUBENURSE_SOCKS_PROXY")
+	s.ReuseConnections = os.Getenv("KUBENURSE_REUSE_CONNECTIONS") == "true"
+
+	if v := os.Getenv("KUBENURSE_TLS_CIPHERS"); v != "" {
+		s.TLSCiphers = strings.Split(v, ",")
+	}
+
+	var err error
+
+	if v, ok := os.LookupEnv("KUBENURSE_DIAL_TIMEOUT"); ok {
+		if s.DialTimeout, err = time.ParseDuration(v); err != nil {
+			return s, fmt.Errorf("parse KUBENURSE_DIAL_TIMEOUT: %w", err)
+		}
+	}
+
+	if v, ok := os.LookupEnv("KUBENURSE_DIAL_KEEPALIVE"); ok {
+		if s.DialKeepAlive, err = time.ParseDuration(v); err != nil {
+			return s, fmt.Errorf("parse KUBENURSE_DIAL_KEEPALIVE: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// WithSettings sets the settings of the checker instead of reading them from the environment.
+func WithSettings(s Settings) Option {
+	return func(o *options) {
+		o.settings = &s
+	}
+}
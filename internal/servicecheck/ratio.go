@@ -0,0 +1,61 @@
+package servicecheck
+
+import (
+	"sync"
+	"time"
+)
+
+const defaultSuccessWindow = 5 * time.Minute
+
+type outcome struct {
+	at      time.Time
+	success bool
+}
+
+// successWindow keeps the outcomes of every check within a sliding time window.
+type successWindow struct {
+	mu       sync.Mutex
+	outcomes map[string][]outcome
+}
+
+func newSuccessWindow() *successWindow {
+	return &successWindow{
+		outcomes: make(map[string][]outcome),
+	}
+}
+
+// observe records the outcome of a check, discards the outcomes older than window and
+// returns the ratio of successful outcomes in the remaining ones.
+func (w *successWindow) observe(label string, success bool, now time.Time, window time.Duration) float64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	outcomes := append(w.outcomes[label], outcome{at: now, success: success})
+
+	// outcomes are in chronological order, find the first one inside the window
+	first := 0
+	for first < len(outcomes) && now.Sub(outcomes[first].at) > window {
+		first++
+	}
+
+	outcomes = outcomes[first:]
+	w.outcomes[label] = outcomes
+
+	var successes int
+
+	for _, o := range outcomes {
+		if o.success {
+			successes++
+		}
+	}
+
+	return float64(successes) / float64(len(outcomes))
+}
+
+// forget discards the outcomes of a check.
+func (w *successWindow) forget(label string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	delete(w.outcomes, label)
+}
@@ -0,0 +1,28 @@
+package servicecheck
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSuccessWindow(t *testing.T) {
+	r := require.New(t)
+
+	w := newSuccessWindow()
+	start := time.Now()
+
+	r.InDelta(1.0, w.observe("me_service", true, start, time.Minute), 0.001)
+	r.InDelta(0.5, w.observe("me_service", false, start.Add(10*time.Second), time.Minute), 0.001)
+	r.InDelta(2.0/3, w.observe("me_service", true, start.Add(20*time.Second), time.Minute), 0.001)
+
+	// labels are tracked independently
+	r.InDelta(0.0, w.observe("me_ingress", false, start, time.Minute), 0.001)
+
+	// the first outcome left the window
+	r.InDelta(2.0/3, w.observe("me_service", true, start.Add(65*time.Second), time.Minute), 0.001)
+
+	// everything but the last outcome left the window
+	r.InDelta(0.0, w.observe("me_service", false, start.Add(10*time.Minute), time.Minute), 0.001)
+}
@@ -4,11 +4,17 @@ package servicecheck
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -20,52 +26,276 @@ const (
 	errStr           = "error"
 	skippedStr       = "skipped"
 	metricsNamespace = "kubenurse"
+
+	defaultSelfCheckPath = "/alwayshappy"
 )
 
+//nolint:gochecknoglobals // compiled once
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
 // New configures the checker with a httpClient and a cache timeout for check
-// results. Other parameters of the Checker struct need to be configured separately.
+// results. Other parameters of the Checker struct can be set with options or need to be configured separately.
 func New(_ context.Context, cl client.Client, promRegistry *prometheus.Registry,
-	allowUnschedulable bool, cacheTTL time.Duration, durationHistogramBuckets []float64) (*Checker, error) {
+	allowUnschedulable bool, cacheTTL time.Duration, durationHistogramBuckets []float64, opts ...Option) (*Checker, error) {
+	var o options
+
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	settings := o.settings
+	if settings == nil {
+		s, err := SettingsFromEnv()
+		if err != nil {
+			return nil, err
+		}
+
+		settings = &s
+	}
+
+	// the check is exposed as "type" in every metric, unless configured
+	checkLabel := "type"
+
+	if v := settings.CheckLabel; v != "" {
+		if err := validateCheckLabel(v); err != nil {
+			return nil, fmt.Errorf("parse KUBENURSE_CHECK_LABEL: %w", err)
+		}
+
+		checkLabel = v
+	}
+
+	// the pod labels are opt-in because of the cardinality
+	var podLabels prometheus.Labels
+
+	if settings.PodLabels {
+		var err error
+
+		if podLabels, err = podConstLabels(); err != nil {
+			return nil, err
+		}
+	}
+
 	errorCounter := prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: metricsNamespace,
-			Name:      "errors_total",
-			Help:      "Kubenurse error counter partitioned by error type",
+			Namespace:   metricsNamespace,
+			Name:        "errors_total",
+			Help:        "Kubenurse error counter partitioned by error type and reason",
+			ConstLabels: podLabels,
 		},
-		[]string{"type"},
+		[]string{checkLabel, "reason"},
 	)
 
 	durationHistogram := prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
+			Namespace:   metricsNamespace,
+			Name:        "request_duration",
+			Help:        "Kubenurse request duration partitioned by target path",
+			Buckets:     durationHistogramBuckets,
+			ConstLabels: podLabels,
+		},
+		[]string{checkLabel},
+	)
+
+	successRatio := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "check_success_ratio",
+			Help:      "Ratio of successful checks within the success window, partitioned by check",
+		},
+		[]string{checkLabel},
+	)
+
+	checkUp := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "check_up",
+			Help:      "Whether the last run of the check succeeded (1) or failed (0), not set for skipped checks",
+		},
+		[]string{checkLabel},
+	)
+
+	checkSkipped := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
 			Namespace: metricsNamespace,
-			Name:      "request_duration",
-			Help:      "Kubenurse request duration partitioned by target path",
+			Name:      "check_skipped",
+			Help:      "Whether the last run of the check was skipped (1) or not (0)",
+		},
+		[]string{checkLabel},
+	)
+
+	neighboursSkipped := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "neighbours_skipped_total",
+			Help:      "Neighbour checks skipped because the node was cordoned since the discovery",
+		},
+	)
+
+	discoveryHistogram := prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "neighbour_discovery_duration_seconds",
+			Help:      "Kubenurse neighbour discovery duration",
 			Buckets:   durationHistogramBuckets,
 		},
-		[]string{"type"},
 	)
 
-	promRegistry.MustRegister(errorCounter, durationHistogram)
+	transitionCounter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "check_transitions_total",
+			Help:      "Kubenurse counter of check state changes between consecutive runs",
+		},
+		[]string{checkLabel, "from", "to"},
+	)
+
+	healthScoreGauge := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "health_score",
+			Help:      "Weighted score between 0 and 100 summarizing the result of the last run",
+		},
+	)
+
+	selectedNeighbourGauge := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "selected_neighbour",
+			Help:      "Set to 1 for every neighbour node checked by this kubenurse",
+		},
+		[]string{"node"},
+	)
+
+	latencyGauge := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "check_latency_ewma_seconds",
+			Help:      "Exponentially weighted moving average of the check duration, partitioned by check",
+		},
+		[]string{checkLabel},
+	)
+
+	neighbourListPartial := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "neighbour_list_partial",
+			Help:      "Set to 1 if the last neighbour discovery only got a part of the paginated pod list",
+		},
+	)
+
+	http2ErrorCounter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http2_errors_total",
+			Help:      "Kubenurse counter of checks failed because of a http2 GOAWAY frame or stream error",
+		},
+		[]string{checkLabel, "reason"},
+	)
+
+	checksInFlight := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "checks_in_flight",
+			Help:      "Number of checks currently executing",
+		},
+	)
+
+	neighbourVersionSkew := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "neighbour_version_skew",
+			Help:      "Number of reachable neighbours running another kubenurse version during the last run",
+		},
+	)
+
+	neighbourhoodReachable := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "neighbourhood_reachable",
+			Help:      "Number of neighbours reachable during the last run",
+		},
+	)
+
+	neighbourhoodTotal := prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "neighbourhood_total",
+			Help:      "Number of neighbours checked (not skipped) during the last run",
+		},
+	)
+
+	webhookErrors := prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "webhook_errors_total",
+			Help:      "Kubenurse counter of results which could not be delivered to the webhook",
+		},
+	)
+
+	promRegistry.MustRegister(errorCounter, durationHistogram, successRatio, neighboursSkipped, discoveryHistogram,
+		transitionCounter, healthScoreGauge, selectedNeighbourGauge, latencyGauge, neighbourListPartial, http2ErrorCounter,
+		checksInFlight, neighbourVersionSkew, webhookErrors, checkUp, checkSkipped, neighbourhoodReachable,
+		neighbourhoodTotal)
 
 	// setup http transport
-	tlsConfig, err := generateTLSConfig(os.Getenv("KUBENURSE_EXTRA_CA"))
+	extraCA := settings.ExtraCA
+
+	tlsConfig, err := generateTLSConfig(extraCA)
 	if err != nil {
 		log.Printf("cannot generate tlsConfig with KUBENURSE_EXTRA_CA: %s", err)
 
 		tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
 	}
 
-	tlsConfig.InsecureSkipVerify = os.Getenv("KUBENURSE_INSECURE") == "true"
+	tlsConfig.InsecureSkipVerify = settings.Insecure
+
+	if v := settings.TLSMinVersion; v != "" {
+		if tlsConfig.MinVersion, err = parseTLSVersion(v); err != nil {
+			return nil, fmt.Errorf("parse KUBENURSE_TLS_MIN_VERSION: %w", err)
+		}
+	}
+
+	if v := settings.TLSMaxVersion; v != "" {
+		if tlsConfig.MaxVersion, err = parseTLSVersion(v); err != nil {
+			return nil, fmt.Errorf("parse KUBENURSE_TLS_MAX_VERSION: %w", err)
+		}
+	}
+
+	if len(settings.TLSCiphers) > 0 {
+		if tlsConfig.CipherSuites, err = parseCipherSuites(strings.Join(settings.TLSCiphers, ",")); err != nil {
+			return nil, fmt.Errorf("parse KUBENURSE_TLS_CIPHERS: %w", err)
+		}
+	}
+
 	dialer := &net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
+		Timeout:   settings.DialTimeout,
+		KeepAlive: settings.DialKeepAlive,
+	}
+
+	// bind the checks to a specific source address, default routing applies otherwise
+	if v := settings.SourceIP; v != "" {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid KUBENURSE_SOURCE_IP %q", v)
+		}
+
+		dialer.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	// checks in SOCKSChecks are routed through this SOCKS5 proxy
+	var socksProxy *url.URL
+
+	if v := settings.SOCKSProxy; v != "" {
+		if socksProxy, err = url.Parse(v); err != nil || (socksProxy.Scheme != "socks5" && socksProxy.Scheme != "socks5h") {
+			return nil, fmt.Errorf("invalid KUBENURSE_SOCKS_PROXY %q, must be a socks5:// or socks5h:// url", v)
+		}
 	}
+
 	transport := &http.Transport{
 		TLSClientConfig:       tlsConfig,
-		Proxy:                 http.ProxyFromEnvironment,
 		DialContext:           dialer.DialContext,
 		ForceAttemptHTTP2:     true,
-		DisableKeepAlives:     os.Getenv("KUBENURSE_REUSE_CONNECTIONS") != "true",
+		DisableKeepAlives:     !settings.ReuseConnections,
 		MaxIdleConns:          100,
 		IdleConnTimeout:       90 * time.Second,
 		TLSHandshakeTimeout:   10 * time.Second,
@@ -74,69 +304,318 @@ func New(_ context.Context, cl client.Client, promRegistry *prometheus.Registry,
 
 	httpClient := &http.Client{
 		Timeout:   5 * time.Second,
-		Transport: withHttptrace(promRegistry, transport, durationHistogramBuckets),
+		Transport: withHttptrace(promRegistry, transport, durationHistogramBuckets, checkLabel),
 	}
 
-	return &Checker{
+	c := &Checker{
 		allowUnschedulable: allowUnschedulable,
 		client:             cl,
 		httpClient:         httpClient,
+		transport:          transport,
+		socksProxy:         socksProxy,
+		dialer:             dialer,
 		cacheTTL:           cacheTTL,
-		errorCounter:       errorCounter,
-		durationHistogram:  durationHistogram,
 		stop:               make(chan struct{}),
-	}, nil
+		selectedMu:         new(sync.Mutex),
+		runMu:              make(chan struct{}, 1),
+		resultMu:           new(sync.RWMutex),
+		successWindow:      newSuccessWindow(),
+		states:             newStateTracker(),
+		latencies:          newLatencyTracker(),
+		tokens:             newTokenCache(),
+		webhook:            newWebhookNotifier(webhookErrors),
+
+		errorCounter:           errorCounter,
+		durationHistogram:      durationHistogram,
+		successRatio:           successRatio,
+		neighboursSkipped:      neighboursSkipped,
+		discoveryHistogram:     discoveryHistogram,
+		transitionCounter:      transitionCounter,
+		healthScoreGauge:       healthScoreGauge,
+		selectedNeighbourGauge: selectedNeighbourGauge,
+		latencyGauge:           latencyGauge,
+		neighbourListPartial:   neighbourListPartial,
+		http2ErrorCounter:      http2ErrorCounter,
+		checksInFlight:         checksInFlight,
+		neighbourVersionSkew:   neighbourVersionSkew,
+		checkUp:                checkUp,
+		checkSkipped:           checkSkipped,
+		neighbourhoodReachable: neighbourhoodReachable,
+		neighbourhoodTotal:     neighbourhoodTotal,
+
+		SelfCheckPath: defaultSelfCheckPath,
+		TokenPath:     K8sTokenFile,
+		SuccessWindow: defaultSuccessWindow,
+		HealthWeights: defaultHealthWeights(),
+
+		WebhookMinInterval: defaultWebhookMinInterval,
+
+		NeighbourTimeout: defaultNeighbourTimeout,
+
+		// the dns protocol checks are opt-in
+		DNSCheckHost:          defaultDNSCheckHost,
+		SkipCheckDNSProtocols: true,
+	}
+
+	httpClient.CheckRedirect = c.checkRedirect
+	transport.Proxy = c.proxy
+
+	c.NeighbourConcurrency = o.neighbourConcurrency
+	c.RunDeadline = o.runTimeout
+
+	return c, nil
 }
 
-// Run runs all servicechecks and returns the result togeter with a boolean which indicates success. The cache
-// is respected.
+// Run runs all servicechecks, including the ones added with RegisterCheck, and returns the result togeter with
+// a boolean which indicates success. The cache is respected. With FailFast, the run stops at the first failed check which is part of CriticalChecks.
+// Concurrent calls, e.g. from RunScheduled and /selftest, are run one after the other.
 func (c *Checker) Run() (Result, bool) {
+	res, haserr, _ := c.RunContext(context.Background())
+
+	return res, haserr
+}
+
+// RunContext is Run bounded by ctx: the checks still in flight are cancelled when ctx is done. An error is only
+// returned if ctx is done before the run started, while waiting for another run.
+func (c *Checker) RunContext(ctx context.Context) (Result, bool, error) {
+	select {
+	case c.runMu <- struct{}{}:
+		defer func() { <-c.runMu }()
+	case <-ctx.Done():
+		return Result{}, true, ctx.Err()
+	}
+
 	var (
 		haserr bool
 		err    error
 	)
 
+	// bound the whole run, checks still in flight are cancelled when the deadline is reached
+	if c.RunDeadline > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, c.RunDeadline)
+		defer cancel()
+	}
+
+	// failures before this run, the result is sent to the webhook if a check transitioned to failure
+	failures := c.states.failureCount()
+
+	c.states.begin()
+
 	// Run Checks
-	res := Result{}
+	res := Result{
+		APIServerEndpoints: make(map[string]string),
+		ServiceEndpoints:   make(map[string]string),
+		Checks:             make(map[string]string),
+	}
 
-	res.APIServerDirect, err = c.measure(c.APIServerDirect, "api_server_direct")
-	haserr = haserr || (err != nil)
+	// failed is set once a critical check failed in fail-fast mode, the remaining checks are not run
+	var failed bool
 
-	res.APIServerDNS, err = c.measure(c.APIServerDNS, "api_server_dns")
-	haserr = haserr || (err != nil)
+	run := func(field *string, check Check, label string) {
+		if failed {
+			return
+		}
 
-	res.MeIngress, err = c.measure(c.MeIngress, "me_ingress")
-	haserr = haserr || (err != nil)
+		var err error
 
-	res.MeService, err = c.measure(c.MeService, "me_service")
-	haserr = haserr || (err != nil)
+		*field, err = c.measure(ctx, check, label)
+		if err != nil {
+			haserr = true
+			failed = c.FailFast && c.CriticalChecks[label]
+		}
+	}
 
-	if c.SkipCheckNeighbourhood {
-		res.NeighbourhoodState = skippedStr
+	type builtinCheck struct {
+		field *string
+		namedCheck
+	}
+
+	var builtins []builtinCheck
+
+	if c.DualStackAPIServer {
+		builtins = append(builtins,
+			builtinCheck{&res.APIServerDirectV4, namedCheck{"api_server_direct_v4", c.APIServerDirectV4}},
+			builtinCheck{&res.APIServerDirectV6, namedCheck{"api_server_direct_v6", c.APIServerDirectV6}},
+		)
 	} else {
-		res.Neighbourhood, err = c.GetNeighbours(context.Background(), c.KubenurseNamespace, c.NeighbourFilter)
-		haserr = haserr || (err != nil)
+		builtins = append(builtins, builtinCheck{&res.APIServerDirect, namedCheck{"api_server_direct", c.APIServerDirect}})
+	}
+
+	builtins = append(builtins,
+		builtinCheck{&res.APIServerDNS, namedCheck{"api_server_dns", c.APIServerDNS}},
+		builtinCheck{&res.MeIngress, namedCheck{"me_ingress", c.MeIngress}},
+		builtinCheck{&res.MeService, namedCheck{"me_service", c.MeService}},
+		builtinCheck{&res.DNSUDP, namedCheck{"dns_udp", c.DNSUDP}},
+		builtinCheck{&res.DNSTCP, namedCheck{"dns_tcp", c.DNSTCP}},
+		builtinCheck{&res.InternetEgress, namedCheck{"internet_egress", c.InternetEgress}},
+	)
+
+	for _, b := range builtins {
+		// a registered check with the same name replaces the built-in one
+		if i := c.customCheckIndex(b.name); i >= 0 {
+			b.fn = c.customChecks[i].fn
+		}
+
+		run(b.field, b.fn, b.name)
+	}
+
+	for i, endpoint := range c.APIServerEndpoints {
+		var state string
+
+		label := fmt.Sprintf("api_server_direct_%d", i)
+		run(&state, c.apiServerEndpoint(endpoint), label)
+
+		// not run in fail-fast mode
+		if state != "" {
+			res.APIServerEndpoints[label] = state
+		}
+	}
 
-		// Neighbourhood special error treating
+	if c.CheckServiceEndpoints && !failed {
+		endpoints, err := c.serviceEndpoints(ctx)
 		if err != nil {
-			res.NeighbourhoodState = err.Error()
+			log.Printf("failed to discover the kubenurse service endpoints: %v", err)
+
+			res.MeServiceEndpoints = err.Error()
+			haserr = true
 		} else {
+			res.MeServiceEndpoints = okStr
+		}
+
+		for _, ep := range endpoints {
+			var state string
+
+			label := "me_service_endpoint_" + ep.name
+			run(&state, c.serviceEndpoint(ep.url), label)
+
+			// not run in fail-fast mode
+			if state != "" {
+				res.ServiceEndpoints[label] = state
+			}
+		}
+	}
+
+	for _, chk := range c.customChecks {
+		if slices.ContainsFunc(builtins, func(b builtinCheck) bool { return b.name == chk.name }) {
+			continue
+		}
+
+		var state string
+
+		run(&state, chk.fn, chk.name)
+
+		// not run in fail-fast mode
+		if state != "" {
+			res.Checks[chk.name] = state
+		}
+	}
+
+	switch {
+	case failed:
+		// fail-fast, the neighbourhood is not checked
+	case c.SkipCheckNeighbourhood:
+		res.NeighbourhoodState = skippedStr
+	default:
+		discoveryStart := time.Now()
+		res.Neighbourhood, err = c.GetNeighbours(ctx, c.KubenurseNamespace, c.NeighbourFilter)
+		c.discoveryHistogram.Observe(time.Since(discoveryStart).Seconds())
+		haserr = haserr || (err != nil)
+
+		// Neighbourhood special error treating, a partial neighbourhood is checked but flagged in the state
+		switch {
+		case errors.Is(err, errPartialNeighbourList):
+			res.NeighbourhoodState = err.Error()
+			res.NeighbourResults, res.reachableNeighbours, res.checkedNeighbours = c.checkNeighbours(ctx, res.Neighbourhood)
+		case err != nil:
+			res.NeighbourhoodState = err.Error()
+		default:
 			res.NeighbourhoodState = okStr
 
 			// Check all neighbours if the neighbourhood was discovered
-			c.checkNeighbours(res.Neighbourhood)
+			res.NeighbourResults, res.reachableNeighbours, res.checkedNeighbours = c.checkNeighbours(ctx, res.Neighbourhood)
 		}
 	}
 
+	// the series of the checks which did not run, e.g. neighbours which are no longer selected, are removed
+	for _, label := range c.states.prune() {
+		c.forget(label)
+	}
+
+	c.healthScoreGauge.Set(c.healthScore(&res))
+
+	res.LatencyEWMA = c.latencies.snapshot()
+
 	// Cache result (used for /alive handler)
+	c.resultMu.Lock()
 	c.LastCheckResult = &res
+	c.resultMu.Unlock()
 
-	return res, haserr
+	if c.WebhookURL != "" && c.states.failureCount() > failures {
+		c.notifyWebhook(&res)
+	}
+
+	return res, haserr, nil
+}
+
+// forget removes the series and the history of a check which did not run.
+func (c *Checker) forget(label string) {
+	c.checkUp.DeleteLabelValues(label)
+	c.checkSkipped.DeleteLabelValues(label)
+	c.successRatio.DeleteLabelValues(label)
+	c.latencyGauge.DeleteLabelValues(label)
+	c.successWindow.forget(label)
+	c.latencies.forget(label)
+}
+
+// ResetConnections closes the idle connections of the http client, e.g. half-open connections left after a
+// network issue, so that the next checks dial new connections.
+func (c *Checker) ResetConnections() {
+	c.transport.CloseIdleConnections()
 }
 
-// RunScheduled runs the checks in the specified interval which can be used to keep the metrics up-to-date. This
-// function does not return until StopScheduled is called.
+// RegisterCheck adds a check which is run after the built-in ones. The name is used as label in the metrics
+// and as key in Result.Checks. Registering the name of a built-in check replaces it, registering a name
+// again replaces the previous check. RegisterCheck must not be called concurrently with Run.
+func (c *Checker) RegisterCheck(name string, fn Check) {
+	if i := c.customCheckIndex(name); i >= 0 {
+		c.customChecks[i].fn = fn
+		return
+	}
+
+	c.customChecks = append(c.customChecks, namedCheck{name: name, fn: fn})
+}
+
+// customCheckIndex returns the index of the registered check with the given name, or -1 if there is none.
+func (c *Checker) customCheckIndex(name string) int {
+	return slices.IndexFunc(c.customChecks, func(chk namedCheck) bool { return chk.name == name })
+}
+
+// LastResult returns the result of the last run, nil if there was none yet.
+func (c *Checker) LastResult() *Result {
+	c.resultMu.RLock()
+	defer c.resultMu.RUnlock()
+
+	return c.LastCheckResult
+}
+
+// RunScheduled runs the checks in the specified interval which can be used to keep the metrics up-to-date. The
+// first run is delayed by StartupDelay, with RunOnStart it is done right after it instead of one interval later.
+// This function does not return until StopScheduled is called.
 func (c *Checker) RunScheduled(d time.Duration) {
+	if c.StartupDelay > 0 {
+		select {
+		case <-time.After(c.StartupDelay):
+		case <-c.stop:
+			return
+		}
+	}
+
+	if c.RunOnStart {
+		c.Run()
+	}
+
 	ticker := time.NewTicker(d)
 	defer ticker.Stop()
 
@@ -155,6 +634,49 @@ func (c *Checker) StopScheduled() {
 	close(c.stop)
 }
 
+// proxy returns the SOCKS5 proxy for the checks in SOCKSChecks, and the proxy configured by the environment
+// variables HTTP_PROXY, HTTPS_PROXY and NO_PROXY otherwise.
+func (c *Checker) proxy(req *http.Request) (*url.URL, error) {
+	label, _ := req.Context().Value(kubenurseTypeKey{}).(string)
+
+	if c.socksProxy != nil && c.SOCKSChecks[label] {
+		return c.socksProxy, nil
+	}
+
+	return http.ProxyFromEnvironment(req)
+}
+
+// validateCheckLabel returns an error if name is not a valid prometheus label name, or collides with the other
+// labels of the kubenurse metrics.
+func validateCheckLabel(name string) error {
+	if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("invalid label name %q", name)
+	}
+
+	switch name {
+	case "code", "method", "event", "from", "to", "node", "pod", "namespace", "reason":
+		return fmt.Errorf("label name %q is already used by the kubenurse metrics", name)
+	}
+
+	return nil
+}
+
+// podConstLabels returns the pod and namespace labels of the kubenurse pod. The pod name is read from POD_NAME,
+// defaulting to the hostname, the namespace from POD_NAMESPACE.
+func podConstLabels() (prometheus.Labels, error) {
+	pod := os.Getenv("POD_NAME")
+	if pod == "" {
+		pod, _ = os.Hostname()
+	}
+
+	namespace := os.Getenv("POD_NAMESPACE")
+	if namespace == "" {
+		return nil, errors.New("POD_NAMESPACE must be set for KUBENURSE_POD_LABELS")
+	}
+
+	return prometheus.Labels{"pod": pod, "namespace": namespace}, nil
+}
+
 // APIServerDirect checks the /version endpoint of the Kubernetes API Server through the direct link
 func (c *Checker) APIServerDirect(ctx context.Context) (string, error) {
 	if c.SkipCheckAPIServerDirect {
@@ -166,6 +688,58 @@ func (c *Checker) APIServerDirect(ctx context.Context) (string, error) {
 	return c.doRequest(ctx, apiurl)
 }
 
+// APIServerDirectV4 checks the /version endpoint of the Kubernetes API Server through the IPv4 address of the direct link
+func (c *Checker) APIServerDirectV4(ctx context.Context) (string, error) {
+	return c.apiServerDirectFamily(ctx, "ip4")
+}
+
+// APIServerDirectV6 checks the /version endpoint of the Kubernetes API Server through the IPv6 address of the direct link
+func (c *Checker) APIServerDirectV6(ctx context.Context) (string, error) {
+	return c.apiServerDirectFamily(ctx, "ip6")
+}
+
+// apiServerDirectFamily resolves the direct link to an address of the given family ("ip4" or "ip6") and
+// checks the /version endpoint of the Kubernetes API Server through this address. KUBERNETES_SERVICE_HOST is usually
+// the cluster IP of the kubernetes service, which has a single family: the check of the other family is skipped.
+func (c *Checker) apiServerDirectFamily(ctx context.Context, network string) (string, error) {
+	if c.SkipCheckAPIServerDirect {
+		return skippedStr, nil
+	}
+
+	var ip net.IP
+
+	if literal := net.ParseIP(c.KubernetesServiceHost); literal != nil {
+		if (literal.To4() != nil) != (network == "ip4") {
+			return skippedStr, nil
+		}
+
+		ip = literal
+	} else {
+		ips, err := net.DefaultResolver.LookupIP(ctx, network, c.KubernetesServiceHost)
+		if err != nil {
+			return err.Error(), err
+		}
+
+		ip = ips[0]
+	}
+
+	apiurl := fmt.Sprintf("https://%s/version", net.JoinHostPort(ip.String(), c.KubernetesServicePort))
+
+	return c.doRequest(ctx, apiurl)
+}
+
+// apiServerEndpoint returns a check of the /version endpoint of a single Kubernetes API Server instance, given
+// as host:port
+func (c *Checker) apiServerEndpoint(endpoint string) Check {
+	return func(ctx context.Context) (string, error) {
+		if c.SkipCheckAPIServerDirect {
+			return skippedStr, nil
+		}
+
+		return c.doRequest(ctx, "https://"+endpoint+"/version")
+	}
+}
+
 // APIServerDNS checks the /version endpoint of the Kubernetes API Server through the Cluster DNS URL
 func (c *Checker) APIServerDNS(ctx context.Context) (string, error) {
 	if c.SkipCheckAPIServerDNS {
@@ -183,7 +757,7 @@ func (c *Checker) MeIngress(ctx context.Context) (string, error) {
 		return skippedStr, nil
 	}
 
-	return c.doRequest(ctx, c.KubenurseIngressURL+"/alwayshappy") //nolint:goconst // readability
+	return c.doRequest(ctx, c.KubenurseIngressURL+c.SelfCheckPath)
 }
 
 // MeService checks if the kubenurse is reachable at the /alwayshappy endpoint through the kubernetes service
@@ -192,26 +766,75 @@ func (c *Checker) MeService(ctx context.Context) (string, error) {
 		return skippedStr, nil
 	}
 
-	return c.doRequest(ctx, c.KubenurseServiceURL+"/alwayshappy")
+	return c.doRequest(ctx, c.KubenurseServiceURL+c.SelfCheckPath)
+}
+
+// InternetEgress checks if the InternetCheckURL outside of the cluster is reachable, honouring the proxy
+// settings of the environment. It is skipped if no InternetCheckURL is configured.
+func (c *Checker) InternetEgress(ctx context.Context) (string, error) {
+	if c.InternetCheckURL == "" {
+		return skippedStr, nil
+	}
+
+	return c.doRequest(ctx, c.InternetCheckURL)
 }
 
 // measure implements metric collections for the check
-func (c *Checker) measure(check Check, label string) (string, error) {
+func (c *Checker) measure(ctx context.Context, check Check, label string) (string, error) {
+	c.checksInFlight.Inc()
+	defer c.checksInFlight.Dec()
+
 	start := time.Now()
 
 	// Add our label (check type) to the context so our http tracer can annotate
 	// metrics and errors based with the label
-	ctx := context.WithValue(context.Background(), kubenurseTypeKey{}, label)
+	ctx = context.WithValue(ctx, kubenurseTypeKey{}, label)
 
 	// Execute check
 	res, err := check(ctx)
 
+	// a kubenurse which is shutting down, a neighbour or this one behind the service or the ingress, is expected
+	// to be unavailable
+	if errors.Is(err, errShuttingDown) {
+		res, err = skippedStr, nil
+	}
+
 	// Process metrics
-	c.durationHistogram.WithLabelValues(label).Observe(time.Since(start).Seconds())
+	duration := time.Since(start).Seconds()
+	c.durationHistogram.WithLabelValues(label).Observe(duration)
 
 	if err != nil {
-		log.Printf("failed request for %s with %v", label, err)
-		c.errorCounter.WithLabelValues(label).Inc()
+		reason := classifyError(err)
+
+		log.Printf("failed request for %s with reason=%s: %v", label, reason, err)
+		c.errorCounter.WithLabelValues(label, reason).Inc()
+
+		if reason == reasonHTTP2GoAway || reason == reasonHTTP2Stream {
+			c.http2ErrorCounter.WithLabelValues(label, reason).Inc()
+		}
+	}
+
+	if res != skippedStr {
+		ratio := c.successWindow.observe(label, err == nil, time.Now(), c.SuccessWindow)
+		c.successRatio.WithLabelValues(label).Set(ratio)
+
+		c.latencyGauge.WithLabelValues(label).Set(c.latencies.observe(label, duration))
+	}
+
+	state := checkState(res, err)
+
+	// skipped checks have no up value, so that they are neither counted as healthy nor as failed
+	if up, skipped := stateValues(state); skipped {
+		c.checkUp.DeleteLabelValues(label)
+		c.checkSkipped.WithLabelValues(label).Set(1)
+	} else {
+		c.checkUp.WithLabelValues(label).Set(up)
+		c.checkSkipped.WithLabelValues(label).Set(0)
+	}
+
+	if prev, ok := c.states.update(label, state); ok && prev != state {
+		log.Printf("check %s changed from %s to %s", label, prev, state)
+		c.transitionCounter.WithLabelValues(label, prev, state).Inc()
 	}
 
 	return res, err
@@ -2,10 +2,19 @@ package servicecheck
 
 import (
 	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/require"
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -36,15 +45,72 @@ func TestCombined(t *testing.T) {
 	// fake client, with a dummy neighbour pod
 	fakeClient := fake.NewFakeClient(&fakeNeighbourPod)
 
-	checker, err := New(context.Background(), fakeClient, prometheus.NewRegistry(), false, 3*time.Second, prometheus.DefBuckets)
+	registry := prometheus.NewRegistry()
+
+	checker, err := New(context.Background(), fakeClient, registry, false, 3*time.Second, prometheus.DefBuckets,
+		WithNeighbourConcurrency(4), WithRunTimeout(time.Minute))
 	r.NoError(err)
 	r.NotNil(checker)
+	r.Equal(4, checker.NeighbourConcurrency)
+	r.Equal(time.Minute, checker.RunDeadline)
 
 	t.Run("run", func(t *testing.T) {
 		r := require.New(t)
 		result, hadError := checker.Run()
 		r.True(hadError)
 		r.Len(result.Neighbourhood, 1)
+		r.Len(result.NeighbourResults, 1)
+		r.Equal("dummy", result.NeighbourResults[0].NodeName)
+		r.False(result.NeighbourResults[0].Reachable)
+		r.NotEmpty(result.NeighbourResults[0].Error)
+		r.InDelta(0.0, testutil.ToFloat64(checker.neighbourhoodReachable), 0.001)
+		r.InDelta(1.0, testutil.ToFloat64(checker.neighbourhoodTotal), 0.001)
+	})
+
+	t.Run("fail-fast", func(t *testing.T) {
+		r := require.New(t)
+
+		checker.FailFast = true
+		checker.CriticalChecks = map[string]bool{"api_server_direct": true}
+
+		defer func() { checker.FailFast = false }()
+
+		result, hadError := checker.Run()
+		r.True(hadError)
+		r.NotEqual(okStr, result.APIServerDirect)
+		r.Empty(result.APIServerDNS)
+		r.Empty(result.Neighbourhood)
+	})
+
+	t.Run("registered", func(t *testing.T) {
+		r := require.New(t)
+
+		checker.RegisterCheck("custom", func(_ context.Context) (string, error) { return okStr, nil })
+		checker.RegisterCheck("me_service", func(_ context.Context) (string, error) { return skippedStr, nil })
+
+		defer func() { checker.customChecks = nil }()
+
+		result, _ := checker.Run()
+		r.Equal(map[string]string{"custom": okStr}, result.Checks)
+		r.Equal(skippedStr, result.MeService)
+
+		// skipped checks have no up value
+		r.Equal(map[string]float64{"custom": 1}, gaugeValues(t, registry, "kubenurse_check_up", "custom", "me_service"))
+		r.Equal(map[string]float64{"custom": 0, "me_service": 1},
+			gaugeValues(t, registry, "kubenurse_check_skipped", "custom", "me_service"))
+	})
+
+	t.Run("apiserver endpoints", func(t *testing.T) {
+		r := require.New(t)
+
+		checker.APIServerEndpoints = []string{"127.0.0.1:1"}
+
+		defer func() { checker.APIServerEndpoints = nil }()
+
+		result, hadError := checker.Run()
+		r.True(hadError)
+		r.Contains(result.APIServerEndpoints, "api_server_direct_0")
+		r.NotEqual(okStr, result.APIServerEndpoints["api_server_direct_0"])
 	})
 
 	t.Run("scheduled", func(t *testing.T) {
@@ -62,3 +128,311 @@ func TestCombined(t *testing.T) {
 		<-stopped
 	})
 }
+
+func TestRunSerialized(t *testing.T) {
+	r := require.New(t)
+
+	checker, err := New(context.Background(), fake.NewFakeClient(), prometheus.NewRegistry(), false, 0, prometheus.DefBuckets)
+	r.NoError(err)
+
+	checker.SkipCheckAPIServerDirect = true
+	checker.SkipCheckAPIServerDNS = true
+	checker.SkipCheckMeIngress = true
+	checker.SkipCheckMeService = true
+	checker.SkipCheckNeighbourhood = true
+
+	var running, overlaps atomic.Int32
+
+	checker.RegisterCheck("slow", func(_ context.Context) (string, error) {
+		if running.Add(1) > 1 {
+			overlaps.Add(1)
+		}
+
+		defer running.Add(-1)
+
+		time.Sleep(10 * time.Millisecond)
+
+		return okStr, nil
+	})
+
+	var wg sync.WaitGroup
+
+	for range 4 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			checker.Run()
+		}()
+	}
+
+	wg.Wait()
+
+	r.Zero(overlaps.Load())
+	r.NotNil(checker.LastResult())
+}
+
+func TestMeServiceShuttingDown(t *testing.T) {
+	r := require.New(t)
+
+	// this kubenurse, behind the service, is shutting down
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set(ShuttingDownHeader, "true")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	registry := prometheus.NewRegistry()
+
+	checker, err := New(context.Background(), fake.NewFakeClient(), registry, false, 0, prometheus.DefBuckets)
+	r.NoError(err)
+
+	checker.KubenurseServiceURL = srv.URL
+	checker.TokenPath = filepath.Join(t.TempDir(), "token")
+	r.NoError(os.WriteFile(checker.TokenPath, []byte("token"), 0o600))
+
+	res, err := checker.measure(context.Background(), checker.MeService, "me_service")
+	r.NoError(err)
+	r.Equal(skippedStr, res)
+
+	// the metrics agree with the result
+	r.Empty(gaugeValues(t, registry, "kubenurse_check_up", "me_service"))
+	r.Equal(map[string]float64{"me_service": 1}, gaugeValues(t, registry, "kubenurse_check_skipped", "me_service"))
+	r.Zero(testutil.CollectAndCount(checker.errorCounter))
+}
+
+func TestPruneChecks(t *testing.T) {
+	r := require.New(t)
+
+	registry := prometheus.NewRegistry()
+
+	checker, err := New(context.Background(), fake.NewFakeClient(), registry, false, 0, prometheus.DefBuckets)
+	r.NoError(err)
+
+	checker.APIServerEndpoints = []string{"127.0.0.1:1"}
+
+	checker.Run()
+
+	const label = "api_server_direct_0"
+
+	for _, name := range []string{"kubenurse_check_up", "kubenurse_check_skipped", "kubenurse_check_success_ratio",
+		"kubenurse_check_latency_ewma_seconds"} {
+		r.Contains(gaugeValues(t, registry, name, label), label, name)
+	}
+
+	// the endpoint is no longer checked, its series and history are removed
+	checker.APIServerEndpoints = nil
+
+	res, _ := checker.Run()
+
+	for _, name := range []string{"kubenurse_check_up", "kubenurse_check_skipped", "kubenurse_check_success_ratio",
+		"kubenurse_check_latency_ewma_seconds"} {
+		r.Empty(gaugeValues(t, registry, name, label), name)
+	}
+
+	r.NotContains(res.LatencyEWMA, label)
+	r.NotContains(checker.states.states, label)
+	r.NotContains(checker.successWindow.outcomes, label)
+}
+
+func TestRunOnStart(t *testing.T) {
+	r := require.New(t)
+
+	checker, err := New(context.Background(), fake.NewFakeClient(), prometheus.NewRegistry(), false, 0, prometheus.DefBuckets)
+	r.NoError(err)
+
+	checker.RunOnStart = true
+
+	go checker.RunScheduled(time.Hour)
+	defer checker.StopScheduled()
+
+	// the result is there long before the first tick
+	r.Eventually(func() bool { return checker.LastResult() != nil }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestStartupDelayStopped(t *testing.T) {
+	r := require.New(t)
+
+	checker, err := New(context.Background(), fake.NewFakeClient(), prometheus.NewRegistry(), false, 0, prometheus.DefBuckets)
+	r.NoError(err)
+
+	checker.StartupDelay = time.Hour
+	checker.RunOnStart = true
+
+	done := make(chan struct{})
+
+	go func() {
+		checker.RunScheduled(time.Hour)
+		close(done)
+	}()
+
+	checker.StopScheduled()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		r.Fail("RunScheduled did not return during the startup delay")
+	}
+
+	// the checks were not run
+	r.Nil(checker.LastResult())
+}
+
+func TestAPIServerDirectFamily(t *testing.T) {
+	r := require.New(t)
+
+	checker, err := New(context.Background(), fake.NewFakeClient(), prometheus.NewRegistry(), false, 0, prometheus.DefBuckets)
+	r.NoError(err)
+
+	checker.KubernetesServicePort = "1" // nothing listens there, the checks which are not skipped fail
+
+	// the cluster IP of the kubernetes service has a single family, the other one is skipped
+	checker.KubernetesServiceHost = "127.0.0.1"
+
+	res, err := checker.APIServerDirectV6(context.Background())
+	r.NoError(err)
+	r.Equal(skippedStr, res)
+
+	_, err = checker.APIServerDirectV4(context.Background())
+	r.Error(err)
+
+	checker.KubernetesServiceHost = "::1"
+
+	res, err = checker.APIServerDirectV4(context.Background())
+	r.NoError(err)
+	r.Equal(skippedStr, res)
+
+	_, err = checker.APIServerDirectV6(context.Background())
+	r.Error(err)
+}
+
+func TestCheckTransitions(t *testing.T) {
+	r := require.New(t)
+
+	checker, err := New(context.Background(), fake.NewFakeClient(), prometheus.NewRegistry(), false, 0, prometheus.DefBuckets)
+	r.NoError(err)
+
+	var fail bool
+
+	check := func(_ context.Context) (string, error) {
+		if fail {
+			return errStr, errors.New("failed")
+		}
+
+		return okStr, nil
+	}
+
+	// ok -> error -> ok -> ok, the first run is no transition and neither is a repeated state
+	for _, fail = range []bool{false, true, false, false} {
+		_, _ = checker.measure(context.Background(), check, "custom")
+	}
+
+	r.Equal(2, testutil.CollectAndCount(checker.transitionCounter))
+	r.InDelta(1.0, testutil.ToFloat64(checker.transitionCounter.WithLabelValues("custom", okStr, errStr)), 0.001)
+	r.InDelta(1.0, testutil.ToFloat64(checker.transitionCounter.WithLabelValues("custom", errStr, okStr)), 0.001)
+}
+
+func TestValidateCheckLabel(t *testing.T) {
+	r := require.New(t)
+
+	r.NoError(validateCheckLabel("kubenurse_check"))
+	r.Error(validateCheckLabel("kubenurse-check"))
+	r.Error(validateCheckLabel("0check"))
+	r.Error(validateCheckLabel("__check"))
+	r.Error(validateCheckLabel("code"))
+	r.Error(validateCheckLabel("pod"))
+}
+
+func TestCheckLabel(t *testing.T) {
+	r := require.New(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+	defer srv.Close()
+
+	settings := DefaultSettings()
+	settings.CheckLabel = "kubenurse_check"
+
+	registry := prometheus.NewRegistry()
+
+	checker, err := New(context.Background(), fake.NewFakeClient(), registry, false, 0, prometheus.DefBuckets,
+		WithSettings(settings))
+	r.NoError(err)
+
+	checker.KubenurseServiceURL = srv.URL
+	checker.TokenPath = filepath.Join(t.TempDir(), "token")
+	r.NoError(os.WriteFile(checker.TokenPath, []byte("token"), 0o600))
+
+	_, err = checker.measure(context.Background(), checker.MeService, "me_service")
+	r.NoError(err)
+
+	_, err = checker.measure(context.Background(), func(_ context.Context) (string, error) {
+		return errStr, errors.New("failed")
+	}, "custom")
+	r.Error(err)
+
+	families, err := registry.Gather()
+	r.NoError(err)
+
+	// the check is carried by the configured label, on the metrics of the checker and of the http client
+	checks := make(map[string][]string)
+
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			for _, l := range m.GetLabel() {
+				r.NotEqual("type", l.GetName(), family.GetName())
+
+				if l.GetName() == settings.CheckLabel {
+					checks[family.GetName()] = append(checks[family.GetName()], l.GetValue())
+				}
+			}
+		}
+	}
+
+	r.Equal([]string{"custom"}, checks["kubenurse_errors_total"])
+	r.ElementsMatch([]string{"custom", "me_service"}, checks["kubenurse_check_up"])
+	r.Equal([]string{"me_service"}, checks["kubenurse_httpclient_requests_total"])
+	r.Equal([]string{"me_service"}, checks["kubenurse_httpclient_request_duration_seconds"])
+	r.NotEmpty(checks["kubenurse_httpclient_trace_request_duration_seconds"])
+}
+
+func TestPodConstLabels(t *testing.T) {
+	r := require.New(t)
+
+	t.Setenv("POD_NAME", "kubenurse-abcde")
+	t.Setenv("POD_NAMESPACE", "")
+
+	_, err := podConstLabels()
+	r.Error(err)
+
+	t.Setenv("POD_NAMESPACE", "kube-system")
+
+	labels, err := podConstLabels()
+	r.NoError(err)
+	r.Equal(prometheus.Labels{"pod": "kubenurse-abcde", "namespace": "kube-system"}, labels)
+}
+
+// gaugeValues returns the values of the gauge with the given name for the given checks, keyed by check.
+func gaugeValues(t *testing.T, registry *prometheus.Registry, name string, checks ...string) map[string]float64 {
+	t.Helper()
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+		for _, m := range family.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "type" && slices.Contains(checks, l.GetValue()) {
+					values[l.GetValue()] = m.GetGauge().GetValue()
+				}
+			}
+		}
+	}
+
+	return values
+}
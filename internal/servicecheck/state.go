@@ -0,0 +1,98 @@
+package servicecheck
+
+import "sync"
+
+// checkState maps the result of a check to okStr, errStr or skippedStr.
+func checkState(res string, err error) string {
+	switch {
+	case err != nil:
+		return errStr
+	case res == skippedStr:
+		return skippedStr
+	default:
+		return okStr
+	}
+}
+
+// stateValues maps a state to the value of the kubenurse_check_up metric, 1 for okStr and 0 for errStr.
+// skipped is set for skippedStr, which has no up value.
+func stateValues(state string) (up float64, skipped bool) {
+	switch state {
+	case okStr:
+		return 1, false
+	case skippedStr:
+		return 0, true
+	default:
+		return 0, false
+	}
+}
+
+// stateTracker keeps the state of every check from the previous run.
+type stateTracker struct {
+	mu     sync.Mutex
+	states map[string]string
+
+	// seen contains the checks updated since the last call of begin
+	seen map[string]bool
+
+	// failures counts the transitions of checks to errStr, including the first failure of a check
+	failures uint64
+}
+
+func newStateTracker() *stateTracker {
+	return &stateTracker{
+		states: make(map[string]string),
+		seen:   make(map[string]bool),
+	}
+}
+
+// begin starts a run, the checks which are not updated until prune are removed by it.
+func (t *stateTracker) begin() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	clear(t.seen)
+}
+
+// prune removes the checks which were not updated since begin, e.g. the neighbours which are no longer selected,
+// and returns them.
+func (t *stateTracker) prune() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var pruned []string
+
+	for label := range t.states {
+		if !t.seen[label] {
+			delete(t.states, label)
+			pruned = append(pruned, label)
+		}
+	}
+
+	return pruned
+}
+
+// update records the state of a check and returns its previous state. ok is false
+// if the check has no previous state.
+func (t *stateTracker) update(label, state string) (prev string, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	prev, ok = t.states[label]
+	t.states[label] = state
+	t.seen[label] = true
+
+	if state == errStr && (!ok || prev != errStr) {
+		t.failures++
+	}
+
+	return prev, ok
+}
+
+// failureCount returns the number of transitions to errStr recorded so far.
+func (t *stateTracker) failureCount() uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.failures
+}
@@ -0,0 +1,43 @@
+package servicecheck
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// tokenTTL is the time a token is cached before the file is read again, as projected tokens are rotated
+const tokenTTL = time.Minute
+
+// tokenCache keeps the content of the service account token file for tokenTTL.
+type tokenCache struct {
+	mu     sync.Mutex
+	path   string
+	token  []byte
+	readAt time.Time
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{}
+}
+
+// get returns the token from the file at path, which is read again if the cached token is older
+// than tokenTTL or was read from another path.
+func (t *tokenCache) get(path string, now time.Time) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token != nil && t.path == path && now.Sub(t.readAt) < tokenTTL {
+		return t.token, nil
+	}
+
+	token, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("load kubernetes serviceaccount token from %s: %w", path, err)
+	}
+
+	t.path, t.token, t.readAt = path, token, now
+
+	return token, nil
+}
@@ -0,0 +1,38 @@
+package servicecheck
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenCache(t *testing.T) {
+	r := require.New(t)
+
+	path := filepath.Join(t.TempDir(), "token")
+	r.NoError(os.WriteFile(path, []byte("first"), 0o600))
+
+	tc := newTokenCache()
+	now := time.Now()
+
+	token, err := tc.get(path, now)
+	r.NoError(err)
+	r.Equal("first", string(token))
+
+	// the rotated token is only read once the ttl expired
+	r.NoError(os.WriteFile(path, []byte("second"), 0o600))
+
+	token, err = tc.get(path, now.Add(tokenTTL/2))
+	r.NoError(err)
+	r.Equal("first", string(token))
+
+	token, err = tc.get(path, now.Add(tokenTTL))
+	r.NoError(err)
+	r.Equal("second", string(token))
+
+	_, err = tc.get(filepath.Join(t.TempDir(), "missing"), now)
+	r.Error(err)
+}
@@ -1,50 +1,163 @@
 package servicecheck
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 )
 
 const (
 	//nolint:gosec // This is the well-known path to Kubernetes serviceaccount tokens.
 	K8sTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
 	k8sCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+	// RequestIDHeader is the header used to correlate a check with the logs of the checked kubenurse
+	RequestIDHeader = "X-Kubenurse-Request-Id"
+
+	// VersionHeader carries the version of kubenurse in the requests of the checks and the /alwayshappy responses.
+	// The version does not change the contract of /alwayshappy, which is only an accepted status code.
+	VersionHeader = "X-Kubenurse-Version"
+
+	// ShuttingDownHeader is set by a kubenurse which answers /alwayshappy with 503 during its shutdown
+	ShuttingDownHeader = "X-Kubenurse-Shutting-Down"
 )
 
-// doRequest does an http request only to get the http status code
+// maxBodySize is the maximum number of bytes of a response body considered by a BodyMatcher
+const maxBodySize = 64 << 10
+
+var (
+	// errShuttingDown is returned by doRequest if the checked kubenurse is shutting down
+	errShuttingDown = errors.New("kubenurse is shutting down")
+
+	// errBodyMismatch is returned by doRequest if the response body does not match the BodyMatcher of the check
+	errBodyMismatch = errors.New("response body does not match")
+)
+
+// BodyMatcher asserts the content of a response body. *regexp.Regexp implements it.
+type BodyMatcher interface {
+	Match(body []byte) bool
+}
+
+// ContainsMatcher is a BodyMatcher which matches bodies containing the substring.
+type ContainsMatcher string
+
+// Match returns true if the body contains the substring.
+func (m ContainsMatcher) Match(body []byte) bool {
+	return bytes.Contains(body, []byte(m))
+}
+
+// doRequest does an http request to get the http status code, which must be accepted by the check. The
+// response body is only read if a BodyMatcher is configured for the check.
 func (c *Checker) doRequest(ctx context.Context, url string) (string, error) {
+	res, _, err := c.doRequestVersion(ctx, url)
+	return res, err
+}
+
+// doRequestVersion is doRequest, which additionally returns the version the checked kubenurse announced in
+// its response, if any.
+func (c *Checker) doRequestVersion(ctx context.Context, url string) (string, string, error) {
 	// Read Bearer Token file from ServiceAccount
-	token, err := os.ReadFile(K8sTokenFile)
+	token, err := c.tokens.get(c.TokenPath, time.Now())
 	if err != nil {
-		return errStr, fmt.Errorf("load kubernetes serviceaccount token from %s: %w", K8sTokenFile, err)
+		return errStr, "", err
 	}
 
 	req, _ := http.NewRequestWithContext(ctx, "GET", url, http.NoBody)
 
-	// Only add the Bearer for API Server Requests
-	if strings.HasSuffix(url, "/version") {
+	requestID := newRequestID()
+	req.Header.Set(RequestIDHeader, requestID)
+
+	if c.Version != "" {
+		req.Header.Set(VersionHeader, c.Version)
+	}
+
+	label, _ := ctx.Value(kubenurseTypeKey{}).(string)
+
+	// Only add the Bearer for API Server Requests, never send it to other endpoints such as internet_egress
+	if strings.HasPrefix(label, "api_server_") && strings.HasSuffix(url, "/version") {
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return err.Error(), err
+		return err.Error(), "", fmt.Errorf("request_id=%s: %w", requestID, err)
 	}
 
 	// Body is non-nil if err is nil, so close it
-	_ = resp.Body.Close()
+	defer resp.Body.Close()
+
+	version := resp.Header.Get(VersionHeader)
+
+	if resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get(ShuttingDownHeader) != "" {
+		return skippedStr, version, fmt.Errorf("request_id=%s: %w", requestID, errShuttingDown)
+	}
 
-	if resp.StatusCode == http.StatusOK {
-		return okStr, nil
+	if !c.statusAccepted(label, resp.StatusCode) {
+		return resp.Status, version, fmt.Errorf("request_id=%s: %w", requestID, &statusError{code: resp.StatusCode, status: resp.Status})
 	}
 
-	return resp.Status, errors.New(resp.Status)
+	if matcher, ok := c.BodyMatchers[label]; ok {
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+		if err != nil {
+			return err.Error(), version, fmt.Errorf("request_id=%s: read body: %w", requestID, err)
+		}
+
+		if !matcher.Match(body) {
+			return errBodyMismatch.Error(), version, fmt.Errorf("request_id=%s: %w", requestID, errBodyMismatch)
+		}
+	}
+
+	return okStr, version, nil
+}
+
+// statusAccepted returns true if the status code is in the AcceptedStatusCodes of the check,
+// or is 200 if the check has none configured.
+func (c *Checker) statusAccepted(label string, code int) bool {
+	accepted, ok := c.AcceptedStatusCodes[label]
+	if !ok {
+		return code == http.StatusOK
+	}
+
+	return slices.Contains(accepted, code)
+}
+
+// checkRedirect does not follow redirects for checks which accept a redirect status code, so
+// that the redirect response itself is checked. Other redirects are followed like the default policy.
+func (c *Checker) checkRedirect(req *http.Request, via []*http.Request) error {
+	label, _ := req.Context().Value(kubenurseTypeKey{}).(string)
+
+	for _, code := range c.AcceptedStatusCodes[label] {
+		if code >= 300 && code < 400 {
+			return http.ErrUseLastResponse
+		}
+	}
+
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+
+	return nil
+}
+
+// newRequestID returns a random identifier for a request.
+func newRequestID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+
+	return hex.EncodeToString(b)
 }
 
 // generateTLSConfig returns a TLSConfig including K8s CA and the user-defined extraCA
@@ -67,13 +180,8 @@ func generateTLSConfig(extraCA string) (*tls.Config, error) {
 
 	// Append extra CA, if set
 	if extraCA != "" {
-		caCert, err := os.ReadFile(extraCA) // Intentionally included by the user.
-		if err != nil {
-			return nil, fmt.Errorf("could not load certificate %s: %w", extraCA, err)
-		}
-
-		if ok := rootCAs.AppendCertsFromPEM(caCert); !ok {
-			return nil, errors.New("could not append extra ca cert to system certpool")
+		if err := appendExtraCA(rootCAs, extraCA); err != nil {
+			return nil, err
 		}
 	}
 
@@ -85,3 +193,86 @@ func generateTLSConfig(extraCA string) (*tls.Config, error) {
 
 	return tlsConfig, nil
 }
+
+// appendExtraCA appends the certificates of the extraCA file to the pool. If extraCA is a directory, every
+// *.pem and *.crt file inside is appended, failures on individual files are logged and do not stop the loading.
+func appendExtraCA(rootCAs *x509.CertPool, extraCA string) error {
+	info, err := os.Stat(extraCA)
+	if err != nil {
+		return fmt.Errorf("could not load certificate %s: %w", extraCA, err)
+	}
+
+	if !info.IsDir() {
+		return appendCAFile(rootCAs, extraCA)
+	}
+
+	entries, err := os.ReadDir(extraCA)
+	if err != nil {
+		return fmt.Errorf("could not read certificate directory %s: %w", extraCA, err)
+	}
+
+	for _, entry := range entries {
+		if ext := filepath.Ext(entry.Name()); entry.IsDir() || (ext != ".pem" && ext != ".crt") {
+			continue
+		}
+
+		if err := appendCAFile(rootCAs, filepath.Join(extraCA, entry.Name())); err != nil {
+			log.Printf("skipping extra ca: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// appendCAFile appends the certificates of a single PEM file to the pool.
+func appendCAFile(rootCAs *x509.CertPool, file string) error {
+	caCert, err := os.ReadFile(file) // Intentionally included by the user.
+	if err != nil {
+		return fmt.Errorf("could not load certificate %s: %w", file, err)
+	}
+
+	if ok := rootCAs.AppendCertsFromPEM(caCert); !ok {
+		return fmt.Errorf("could not append extra ca cert %s to system certpool", file)
+	}
+
+	return nil
+}
+
+// parseTLSVersion parses a TLS version such as "1.2" or "1.3".
+func parseTLSVersion(v string) (uint16, error) {
+	versions := map[string]uint16{
+		"1.0": tls.VersionTLS10,
+		"1.1": tls.VersionTLS11,
+		"1.2": tls.VersionTLS12,
+		"1.3": tls.VersionTLS13,
+	}
+
+	version, ok := versions[v]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", v)
+	}
+
+	return version, nil
+}
+
+// parseCipherSuites parses a comma-separated list of cipher suite names, e.g.
+// "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384".
+func parseCipherSuites(v string) ([]uint16, error) {
+	suites := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+
+	for _, name := range strings.Split(v, ",") {
+		id, ok := suites[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
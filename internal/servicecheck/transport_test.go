@@ -0,0 +1,128 @@
+package servicecheck
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// generateCAPEM returns a PEM encoded self-signed CA certificate.
+func generateCAPEM(t *testing.T, cn string) []byte {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestAppendExtraCA(t *testing.T) {
+	dir := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.pem"), generateCAPEM(t, "a"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.crt"), generateCAPEM(t, "b"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.pem"), []byte("not a certificate"), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "README.md"), []byte("ignored"), 0o600))
+
+	t.Run("file", func(t *testing.T) {
+		pool := x509.NewCertPool()
+		require.NoError(t, appendExtraCA(pool, filepath.Join(dir, "a.pem")))
+		require.True(t, pool.Equal(poolOf(t, dir, "a.pem")))
+	})
+
+	t.Run("broken file", func(t *testing.T) {
+		require.Error(t, appendExtraCA(x509.NewCertPool(), filepath.Join(dir, "broken.pem")))
+	})
+
+	t.Run("directory", func(t *testing.T) {
+		pool := x509.NewCertPool()
+		require.NoError(t, appendExtraCA(pool, dir))
+		require.True(t, pool.Equal(poolOf(t, dir, "a.pem", "b.crt")))
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		require.Error(t, appendExtraCA(x509.NewCertPool(), filepath.Join(dir, "missing")))
+	})
+}
+
+func poolOf(t *testing.T, dir string, files ...string) *x509.CertPool {
+	t.Helper()
+
+	pool := x509.NewCertPool()
+
+	for _, f := range files {
+		pemBytes, err := os.ReadFile(filepath.Join(dir, f))
+		require.NoError(t, err)
+		require.True(t, pool.AppendCertsFromPEM(pemBytes))
+	}
+
+	return pool
+}
+
+func TestParseTLSSettings(t *testing.T) {
+	r := require.New(t)
+
+	v, err := parseTLSVersion("1.3")
+	r.NoError(err)
+	r.Equal(uint16(tls.VersionTLS13), v)
+
+	_, err = parseTLSVersion("1.4")
+	r.Error(err)
+
+	suites, err := parseCipherSuites("TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384")
+	r.NoError(err)
+	r.Equal([]uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384}, suites)
+
+	_, err = parseCipherSuites("TLS_RSA_WITH_RC4_128_SHA") // insecure
+	r.Error(err)
+}
+
+func TestProxy(t *testing.T) {
+	r := require.New(t)
+
+	socksProxy, _ := url.Parse("socks5://proxy.example.com:1080")
+	c := Checker{socksProxy: socksProxy, SOCKSChecks: map[string]bool{"internet_egress": true}}
+
+	newRequest := func(label string) *http.Request {
+		ctx := context.WithValue(context.Background(), kubenurseTypeKey{}, label)
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://example.com", http.NoBody)
+
+		return req
+	}
+
+	proxy, err := c.proxy(newRequest("internet_egress"))
+	r.NoError(err)
+	r.Equal(socksProxy, proxy)
+
+	t.Setenv("HTTPS_PROXY", "")
+
+	proxy, err = c.proxy(newRequest("me_ingress"))
+	r.NoError(err)
+	r.Nil(proxy)
+}
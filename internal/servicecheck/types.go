@@ -2,7 +2,10 @@ package servicecheck
 
 import (
 	"context"
+	"net"
 	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -17,38 +20,163 @@ type Checker struct {
 	SkipCheckMeIngress  bool
 	SkipCheckMeService  bool
 
+	// SelfCheckPath is the path of the kubenurse /alwayshappy endpoint, used for
+	// the me_ingress, me_service and neighbourhood checks
+	SelfCheckPath string
+
 	// shutdownDuration defines the time during which kubenurse will wait before stopping
 	ShutdownDuration time.Duration
 
+	// FailFast stops a run at the first failure of a check in CriticalChecks (keyed by check name)
+	FailFast       bool
+	CriticalChecks map[string]bool
+
+	// RunDeadline bounds the duration of a whole Run, if set
+	RunDeadline time.Duration
+
+	// StartupDelay defines the time RunScheduled waits before starting the periodic checks
+	StartupDelay time.Duration
+
+	// RunOnStart makes RunScheduled run the checks once right after the StartupDelay, before the first interval
+	RunOnStart bool
+
+	// CheckServiceEndpoints enables the check of every ready endpoint of the kubenurse service, given by
+	// KubenurseServiceName and KubenurseServiceNamespace, as me_service_endpoint_<pod>
+	CheckServiceEndpoints     bool
+	KubenurseServiceName      string
+	KubenurseServiceNamespace string
+
 	// Kubernetes API
 	KubernetesServiceHost    string
 	KubernetesServicePort    string
 	SkipCheckAPIServerDirect bool
 	SkipCheckAPIServerDNS    bool
+	DualStackAPIServer       bool // check the direct link over IPv4 and IPv6 separately
+
+	// APIServerEndpoints are the host:port of the individual API Server instances, each one is checked
+	// as api_server_direct_<index>
+	APIServerEndpoints []string
+
+	// TokenPath is the path of the bearer token sent to the API server, e.g. a projected token with
+	// a custom audience. It is read again every tokenTTL as projected tokens are rotated.
+	TokenPath string
 
 	// Neighbourhood
 	KubenurseNamespace     string
 	NeighbourFilter        string
 	NeighbourLimit         int
+	NeighbourCheckAll      bool    // check every discovered neighbour, NeighbourLimit and NeighbourFraction are ignored
+	NeighbourIncludeSelf   bool    // check the own pod and the other pods on the current node as well
+	NeighbourFraction      float64 // if set, the limit is this fraction of the discovered neighbours
+	NeighbourFractionMin   int
+	NeighbourFractionMax   int
+	NeighbourScheme        string // defaults to https if UseTLS is set, http otherwise
+	NeighbourPort          string // defaults to 8443 if UseTLS is set, 8080 otherwise
+	NeighbourUseDNS        bool   // query neighbours by pod DNS name, if available
+	NeighbourPageSize      int64  // list the neighbour pods in pages of this size, if set
 	allowUnschedulable     bool
 	SkipCheckNeighbourhood bool
 
+	// NeighbourTimeout is the timeout of a single neighbour check, the timeout of the http client applies if 0
+	NeighbourTimeout time.Duration
+
+	// NeighbourConcurrency is the number of neighbours checked concurrently, they are checked one after the
+	// other if it is 0 or 1
+	NeighbourConcurrency int
+
+	// ExposeSelectedNeighbours enables the kubenurse_selected_neighbour metric
+	ExposeSelectedNeighbours bool
+
+	// neighbours checked during the last run
+	selectedMu         *sync.Mutex
+	selectedNeighbours []*Neighbour
+
+	// SOCKSChecks are the names of the checks routed through the SOCKS5 proxy given by KUBENURSE_SOCKS_PROXY
+	SOCKSChecks map[string]bool
+
+	// InternetCheckURL is an url outside of the cluster checked by internet_egress, the check is skipped if empty
+	InternetCheckURL string
+
+	// DNS over UDP and TCP
+	DNSCheckHost          string
+	SkipCheckDNSProtocols bool
+
 	// TLS
 	UseTLS bool
 
+	// AcceptedStatusCodes are the status codes considered successful, keyed by check name. Only 200 is
+	// accepted for checks without configured status codes.
+	AcceptedStatusCodes map[string][]int
+
+	// Version of this kubenurse, announced to the checked kubenurses and compared to the version of the neighbours
+	Version string
+
+	// BodyMatchers are the assertions on the response body of successful requests, keyed by check name
+	BodyMatchers map[string]BodyMatcher
+
 	// Controller runtime cached client
 	client client.Client
 
+	// HealthWeights are the weights of the checks (and the neighbourhood) in the health score
+	HealthWeights map[string]float64
+
+	// WebhookURL receives the result of every run in which a check transitioned to failure, if set.
+	// Deliveries are at least WebhookMinInterval apart.
+	WebhookURL         string
+	WebhookMinInterval time.Duration
+
+	// SuccessWindow is the time window over which the success ratio of the checks is computed
+	SuccessWindow time.Duration
+
 	// metrics
-	errorCounter      *prometheus.CounterVec
-	durationHistogram *prometheus.HistogramVec
+	errorCounter       *prometheus.CounterVec
+	durationHistogram  *prometheus.HistogramVec
+	successRatio       *prometheus.GaugeVec
+	neighboursSkipped  prometheus.Counter
+	discoveryHistogram prometheus.Histogram
+	transitionCounter  *prometheus.CounterVec
+	healthScoreGauge   prometheus.Gauge
+
+	selectedNeighbourGauge *prometheus.GaugeVec
+	latencyGauge           *prometheus.GaugeVec
+	neighbourListPartial   prometheus.Gauge
+	http2ErrorCounter      *prometheus.CounterVec
+	checksInFlight         prometheus.Gauge
+	neighbourVersionSkew   prometheus.Gauge
+	checkUp                *prometheus.GaugeVec
+	checkSkipped           *prometheus.GaugeVec
+	neighbourhoodReachable prometheus.Gauge
+	neighbourhoodTotal     prometheus.Gauge
+
+	successWindow *successWindow
+	states        *stateTracker
+	latencies     *latencyTracker
+	tokens        *tokenCache
+	webhook       *webhookNotifier
+
+	// checks added with RegisterCheck, in registration order
+	customChecks []namedCheck
 
 	// Http Client for https requests
 	httpClient *http.Client
 
-	// LastCheckResult represents a cached check result
+	// transport of the http client, kept to close its idle connections
+	transport *http.Transport
+
+	// socksProxy is the SOCKS5 proxy used by the checks in SOCKSChecks
+	socksProxy *url.URL
+
+	// dialer used by the http transport and the dns checks
+	dialer *net.Dialer
+
+	// LastCheckResult represents a cached check result, use LastResult to read it while checks are running
 	LastCheckResult *Result
 
+	// runMu serializes the runs, it is a channel so that waiting for it can be cancelled. resultMu protects
+	// LastCheckResult
+	runMu    chan struct{}
+	resultMu *sync.RWMutex
+
 	// cacheTTL defines the TTL of how long a cached result is valid
 	cacheTTL time.Duration
 
@@ -59,11 +187,43 @@ type Checker struct {
 // Result contains the result of a performed check run
 type Result struct {
 	APIServerDirect    string       `json:"api_server_direct"`
+	APIServerDirectV4  string       `json:"api_server_direct_v4,omitempty"`
+	APIServerDirectV6  string       `json:"api_server_direct_v6,omitempty"`
 	APIServerDNS       string       `json:"api_server_dns"`
 	MeIngress          string       `json:"me_ingress"`
 	MeService          string       `json:"me_service"`
+	DNSUDP             string       `json:"dns_udp"`
+	DNSTCP             string       `json:"dns_tcp"`
+	InternetEgress     string       `json:"internet_egress"`
 	NeighbourhoodState string       `json:"neighbourhood_state"`
 	Neighbourhood      []*Neighbour `json:"neighbourhood"`
+
+	// NeighbourResults contains the outcome of the check of every selected neighbour
+	NeighbourResults []NeighbourResult `json:"neighbour_results"`
+
+	// APIServerEndpoints contains the results of the checks of the APIServerEndpoints, keyed by check name
+	APIServerEndpoints map[string]string `json:"api_server_endpoints,omitempty"`
+
+	// MeServiceEndpoints is the state of the discovery of the kubenurse service endpoints
+	MeServiceEndpoints string `json:"me_service_endpoints,omitempty"`
+
+	// ServiceEndpoints contains the results of the checks of the kubenurse service endpoints, keyed by check name
+	ServiceEndpoints map[string]string `json:"service_endpoints,omitempty"`
+
+	// Checks contains the results of the checks added with RegisterCheck
+	Checks map[string]string `json:"checks,omitempty"`
+
+	// LatencyEWMA is the smoothed duration of every check in seconds
+	LatencyEWMA map[string]float64 `json:"latency_ewma_seconds"`
+
+	reachableNeighbours int
+	checkedNeighbours   int
+}
+
+// namedCheck is a check together with its name, which is used as label in the metrics.
+type namedCheck struct {
+	name string
+	fn   Check
 }
 
 // Check is the signature used by all checks that the checker can execute.
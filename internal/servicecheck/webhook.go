@@ -0,0 +1,156 @@
+package servicecheck
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// webhookQueueSize is the number of results waiting for delivery, further results are dropped
+	webhookQueueSize = 8
+
+	// webhookAttempts is the number of deliveries attempted for a result
+	webhookAttempts = 3
+
+	// webhookBackoff is the delay before the first retry, it is doubled for every further retry
+	webhookBackoff = time.Second
+
+	defaultWebhookMinInterval = time.Minute
+)
+
+// webhookNotifier delivers the results of the runs in which a check failed to WebhookURL. Deliveries
+// happen in a separate goroutine, so that the scheduled runs are never blocked.
+type webhookNotifier struct {
+	client *http.Client
+	queue  chan webhookPayload
+	errors prometheus.Counter
+	start  sync.Once
+
+	// backoff is the delay before the first retry, kept here to be shortened in tests
+	backoff time.Duration
+}
+
+// webhookPayload is the body POSTed to WebhookURL.
+type webhookPayload struct {
+	url string
+
+	Time   time.Time `json:"time"`
+	Failed int       `json:"failed"`
+	Total  int       `json:"total"`
+	Result *Result   `json:"result"`
+}
+
+func newWebhookNotifier(errors prometheus.Counter) *webhookNotifier {
+	return &webhookNotifier{
+		client:  &http.Client{Timeout: 5 * time.Second},
+		queue:   make(chan webhookPayload, webhookQueueSize),
+		errors:  errors,
+		backoff: webhookBackoff,
+	}
+}
+
+// notifyWebhook queues the result for delivery to WebhookURL, the delivery goroutine is started on first use.
+// The result is dropped if the queue is full.
+func (c *Checker) notifyWebhook(res *Result) {
+	w := c.webhook
+
+	w.start.Do(func() {
+		go w.run(c.stop, c.WebhookMinInterval)
+	})
+
+	payload := webhookPayload{
+		url:    c.WebhookURL,
+		Time:   time.Now(),
+		Result: res,
+	}
+
+	payload.Failed, payload.Total = res.FailedChecks()
+
+	select {
+	case w.queue <- payload:
+	default:
+		log.Printf("webhook queue is full, dropping the result")
+		w.errors.Inc()
+	}
+}
+
+// run delivers the queued results, at most one every minInterval, until stop is closed.
+func (w *webhookNotifier) run(stop <-chan struct{}, minInterval time.Duration) {
+	var last time.Time
+
+	for {
+		select {
+		case payload := <-w.queue:
+			// rate limit the deliveries, results queued meanwhile are dropped once the queue is full
+			if wait := minInterval - time.Since(last); !last.IsZero() && wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-stop:
+					return
+				}
+			}
+
+			last = time.Now()
+
+			if err := w.deliver(stop, payload); err != nil {
+				log.Printf("failed to deliver the result to the webhook: %v", err)
+				w.errors.Inc()
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// deliver POSTs the payload, retrying with an exponential backoff.
+func (w *webhookNotifier) deliver(stop <-chan struct{}, payload webhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("marshal webhook payload: %w", err)
+	}
+
+	backoff := w.backoff
+
+	for attempt := 1; ; attempt++ {
+		if err = w.post(payload.url, body); err == nil || attempt == webhookAttempts {
+			return err
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-stop:
+			return err
+		}
+	}
+}
+
+func (w *webhookNotifier) post(url string, body []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+
+	return nil
+}
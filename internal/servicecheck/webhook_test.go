@@ -0,0 +1,60 @@
+package servicecheck
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookDeliver(t *testing.T) {
+	r := require.New(t)
+
+	var calls atomic.Int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// the first attempt fails, the retry succeeds
+		if calls.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		var payload webhookPayload
+		r.NoError(json.NewDecoder(req.Body).Decode(&payload))
+		r.Equal(1, payload.Failed)
+		r.Equal(errStr, payload.Result.MeService)
+	}))
+	defer srv.Close()
+
+	w := newWebhookNotifier(prometheus.NewCounter(prometheus.CounterOpts{Name: "webhook_errors_total"}))
+	w.backoff = time.Millisecond
+
+	payload := webhookPayload{url: srv.URL, Failed: 1, Total: 1, Result: &Result{MeService: errStr}}
+
+	r.NoError(w.deliver(make(chan struct{}), payload))
+	r.Equal(int32(2), calls.Load())
+
+	// the delivery gives up after webhookAttempts
+	payload.url = srv.URL + "/unreachable\x7f"
+	r.Error(w.deliver(make(chan struct{}), payload))
+}
+
+func TestStateTrackerFailures(t *testing.T) {
+	r := require.New(t)
+
+	s := newStateTracker()
+
+	s.update("me_service", errStr)
+	s.update("me_service", errStr)
+	s.update("me_ingress", okStr)
+	r.Equal(uint64(1), s.failureCount())
+
+	s.update("me_service", okStr)
+	s.update("me_service", errStr)
+	r.Equal(uint64(2), s.failureCount())
+}
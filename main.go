@@ -13,6 +13,7 @@ import (
 
 	"github.com/postfinance/kubenurse/internal/kubenurse"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	controllerruntime "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/client"
@@ -26,48 +27,62 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer cancel()
 
-	restConf, err := controllerruntime.GetConfig()
+	// options from the config file, environment variables take precedence
+	nurseOpts, err := kubenurse.LoadOptions(os.Getenv("KUBENURSE_CONFIG"))
 	if err != nil {
 		log.Println(err)
 		return
 	}
 
-	kubenurseNs := os.Getenv("KUBENURSE_NAMESPACE")
-
-	ca, err := cache.New(restConf, cache.Options{
-		ByObject: map[client.Object]cache.ByObject{
-			&corev1.Pod{}: {Namespaces: map[string]cache.Config{
-				kubenurseNs: {},
-			}},
-			&corev1.Node{}: {},
-		},
-	})
-
+	restConf, err := controllerruntime.GetConfig()
 	if err != nil {
-		log.Printf("error during cache creation: %s", err)
+		log.Println(err)
 		return
 	}
 
-	go func() {
-		if err = ca.Start(ctx); err != nil && !errors.Is(err, context.Canceled) {
-			log.Printf("client cache error: %s", err)
-			cancel()
+	clientOpts := client.Options{}
+
+	// per default, pods and nodes are read from a local watch cache instead of listing them
+	// from the kube-apiserver on every check
+	if nurseOpts.UseCache {
+		kubenurseNs := nurseOpts.Namespace
+
+		ca, err := cache.New(restConf, cache.Options{
+			ByObject: map[client.Object]cache.ByObject{
+				&corev1.Pod{}: {Namespaces: map[string]cache.Config{
+					kubenurseNs: {},
+				}},
+				&corev1.Node{}: {},
+				&discoveryv1.EndpointSlice{}: {Namespaces: map[string]cache.Config{
+					kubenurseNs: {},
+				}},
+			},
+		})
+
+		if err != nil {
+			log.Printf("error during cache creation: %s", err)
+			return
 		}
-	}()
 
-	opts := client.Options{
-		Cache: &client.CacheOptions{
+		go func() {
+			if err = ca.Start(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				log.Printf("client cache error: %s", err)
+				cancel()
+			}
+		}()
+
+		clientOpts.Cache = &client.CacheOptions{
 			Reader: ca,
-		},
+		}
 	}
 
-	c, err := client.New(restConf, opts)
+	c, err := client.New(restConf, clientOpts)
 	if err != nil {
 		log.Printf("error while starting controller-runtime client: %s", err)
 		return
 	}
 
-	server, err := kubenurse.New(ctx, c)
+	server, err := kubenurse.NewWithOptions(ctx, c, nurseOpts)
 	if err != nil {
 		log.Printf("%s", err)
 		return